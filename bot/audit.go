@@ -0,0 +1,102 @@
+package bot
+
+// audit logs of evaluations
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	maxAuditLogBytes = 10 * 1024 * 1024 // 10 MB
+)
+
+// auditEntry is a line of audit log
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username,omitempty"`
+	ChatID   int64     `json:"chat_id"`
+	Code     string    `json:"code"`
+	Errored  bool      `json:"errored"`
+	Owner    bool      `json:"owner,omitempty"` // whether it was evaluated by the owner or not
+}
+
+// auditLogger appends audit logs to a file as JSON lines
+type auditLogger struct {
+	path    string
+	ownerID string // username of the owner
+
+	sync.Mutex
+}
+
+// newAuditLogger returns a new audit logger (nil if given path is empty)
+func newAuditLogger(path, ownerID string) *auditLogger {
+	if path == "" {
+		return nil
+	}
+
+	return &auditLogger{
+		path:    path,
+		ownerID: ownerID,
+	}
+}
+
+// log appends an audit log of given message's evaluation
+func (l *auditLogger) log(message *telegram.Message, code string, errored bool) {
+	if l == nil {
+		return
+	}
+
+	entry := auditEntry{
+		Time:    time.Now(),
+		ChatID:  message.Chat.ID,
+		Code:    code,
+		Errored: errored,
+	}
+	if message.From != nil {
+		entry.UserID = message.From.ID
+		if message.From.Username != nil {
+			entry.Username = *message.From.Username
+			entry.Owner = l.ownerID != "" && entry.Username == l.ownerID
+		}
+	}
+
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("failed to marshal audit log: %s", err)
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.rotateIfNeeded()
+
+	var f *os.File
+	if f, err = os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+		defer f.Close()
+
+		if _, err = f.Write(append(bytes, '\n')); err != nil {
+			log.Printf("failed to write audit log: %s", err)
+		}
+	} else {
+		log.Printf("failed to open audit log file %s: %s", l.path, err)
+	}
+}
+
+// rotate the audit log file if it grew too large (keeps only one previous file)
+//
+// NOTE: should be called while locked
+func (l *auditLogger) rotateIfNeeded() {
+	if info, err := os.Stat(l.path); err == nil && info.Size() >= maxAuditLogBytes {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			log.Printf("failed to rotate audit log file %s: %s", l.path, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package bot
+
+// evaluation of multiple top-level forms one by one (with numbered results)
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	maxFormLabelLength = 40 // in runes
+)
+
+// evaluate given top-level forms one by one, and join their results as a numbered transcript
+//
+// (`rest` is the trailing text which could not be read as a form, so it is not evaluated)
+func (b *Bot) evaluateForms(message *telegram.Message, code string, forms []string, rest string) (result string, entities []telegram.MessageEntity) {
+	input, finished := b.watchForInput(message, code)
+	defer finished()
+
+	session := b.sessions.get(message.Chat.ID)
+
+	var sb strings.Builder
+	var failed, stopped bool
+	for i, form := range forms {
+		if i > 0 {
+			sb.WriteString("\n\n")
+		}
+		fmt.Fprintf(&sb, formLabelFormat, i+1, formLabel(form))
+
+		received, err := b.evalReading(message.Chat.ID, form, input)
+		if err != nil {
+			if errors.Is(err, context.Canceled) { // stopped with /stop
+				sb.WriteString(messageEvalStopped)
+			} else {
+				fmt.Fprintf(&sb, "error: %s", err)
+			}
+			failed, stopped = true, true
+			break
+		}
+
+		text, styled := b.evaluated(message, received)
+		entities = append(entities, shiftEntities(styled, utf16Len(sb.String()))...)
+		sb.WriteString(text)
+
+		failed = failed || b.failed(received)
+	}
+	if rest != "" && !stopped {
+		sb.WriteString("\n\n")
+		fmt.Fprintf(&sb, formLabelFormat, len(forms)+1, formLabel(rest))
+		sb.WriteString(messageFormNotEvaluated)
+		failed = true
+	}
+	result = sb.String()
+
+	session.appendHistory(message.MessageID, code, result)
+	b.auditLogger.log(message, code, failed)
+
+	return result, entities
+}
+
+// label of given form (its first line, truncated if too long)
+func formLabel(form string) string {
+	label, _, multiline := strings.Cut(strings.TrimSpace(form), "\n")
+	if runes := []rune(strings.TrimSpace(label)); len(runes) > maxFormLabelLength {
+		label, multiline = string(runes[:maxFormLabelLength]), true
+	}
+	if multiline {
+		label += " ..."
+	}
+
+	return label
+}
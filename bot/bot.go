@@ -0,0 +1,2332 @@
+package bot
+
+// Telegram bot for Clojure REPL
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+	"olympos.io/encoding/edn"
+)
+
+const (
+	tempDir = "/tmp"
+
+	chatTypeSupergroup telegram.ChatType = "supergroup" // not defined in telegram-bot-go
+
+	maxDownloadBytes       = 1024 * 1024 // 1 MB
+	downloadTimeoutSeconds = 30
+
+	evalQueueTimeoutSeconds = 10 // how long to wait for a free slot when `max_concurrent_evals` is reached
+)
+
+const (
+	defaultMonitorInterval = 3
+	defaultMaxInputChars   = 10000
+
+	defaultMaxMessagesPerResult = 5
+	defaultReplLogLines         = 20
+	defaultReplyCacheSize       = 100
+	defaultPublicsPageSize      = 100
+	defaultStartupRetries       = 3
+	startupRetryBaseDelay       = 1 * time.Second // doubled on every retry
+	maxMessageLength            = 4000            // in runes (max: 4096, leaving some room for formatting)
+
+	defaultNamespace = "user"
+
+	sessionReapInterval = 1 * time.Minute
+	chatActionInterval  = 4 * time.Second // chat actions are shown for 5 seconds at most
+
+	// telegram commands
+	commandStart        = "/start"
+	commandPublics      = "/publics"
+	commandReset        = "/reset"
+	commandHideKeyboard = "/hidekeyboard"
+	commandShowKeyboard = "/showkeyboard"
+	commandKeyboard     = "/keyboard"
+	commandNow          = "/now"
+	commandStop         = "/stop"
+	commandReplLog      = "/replog"
+	commandType         = "/type"
+	commandMacroexpand  = "/macroexpand"
+	commandMacroexpand1 = "/macroexpand-1"
+	commandDeref        = "/deref"
+	commandTest         = "/test"
+	commandVersion      = "/version"
+	commandNamespaces   = "/namespaces"
+	commandCapture      = "/capture"
+	commandTranscript   = "/transcript"
+	commandShell        = "/shell"
+	commandLast         = "/last"
+	commandAs           = "/as"
+	commandDeps         = "/deps"
+	commandEval         = "/eval"
+	commandComplete     = "/complete"
+	commandFindDoc      = "/find-doc"
+	commandStatus       = "/status"
+	commandMeta         = "/meta"
+	commandCategory     = "/category"
+	commandPst          = "/pst"
+	commandHelp         = "/help"
+	commandSessions     = "/sessions"
+	commandLength       = "/length"
+	commandQuit         = "/quit"
+	commandBuffer       = "/buffer"
+	commandRun          = "/run"
+	commandDump         = "/dump"
+
+	// telegram messages
+	messageWelcome                  = "welcome!"
+	messageFailedToListPublics      = "failed to list public definitions."
+	messageFailedToReset            = "failed to reset REPL."
+	messageErrorNothingReceived     = "nothing received from REPL."
+	messageKeyboardHidden           = "keyboard hidden. (send /showkeyboard to show it again)"
+	messageKeyboardShown            = "keyboard shown."
+	messageKeyboardResent           = "keyboard sent again."
+	messageNoSuchHistory            = "no such result in history."
+	messageUsageAs                  = "usage: /as <name> <form>"
+	messageInvalidSymbolFormat      = "invalid symbol: %s"
+	messageInvalidNamespaceFormat   = "invalid namespace: %s"
+	messageBoundFormat              = "bound to `%s`."
+	messageUsageDeps                = "usage: /deps <coord> <version> (eg. /deps org.clojure/data.json 2.5.0)"
+	messageInvalidDepsFormat        = "invalid coordinate or version: %s %s"
+	messageDepsUnsupported          = "adding libraries at runtime is not supported by this Clojure (1.12+ is needed)."
+	messageDepsAddedFormat          = "added %s %s."
+	messageAdminOnly                = "only admins can use this command."
+	messageStartingRepl             = "starting REPL..."
+	messageConnectingRepl           = "connecting to REPL..."
+	messageInputTooLongFormat       = "input is too long (max: %d characters), try uploading it as a file instead."
+	messageFailedToParseEdnFormat   = "failed to parse edn: %s"
+	messageUsageComplete            = "usage: /complete <prefix>"
+	messageNoCompletions            = "no completions."
+	messageMoreCompletionsFormat    = "... and %d more (%d total)"
+	messageUsageFindDoc             = "usage: /find-doc <pattern>"
+	messageNoDocsFound              = "no matching docs."
+	messageDocsFoundFormat          = "%d matching doc(s):\n\n%s"
+	messageTruncated                = "\n... (truncated)"
+	messageNamespaceReset           = "namespace reset."
+	messageReplConnected            = "connected"
+	messageReplNotConnected         = "not connected"
+	messageStatusReplFormat         = "REPL: %s"
+	messageStatusLatencyFormat      = "latency: %.1f ms"
+	messageStatusUptimeFormat       = "uptime: %s"
+	messageStatusEvalsFormat        = "evaluations: %d in flight (max: %d), %d rejected"
+	messageHintReaderConditionals   = "\n\n(reader conditionals like `#?(:clj ...)` are only allowed in .cljc files)"
+	messageUsageMeta                = "usage: /meta <symbol>"
+	messageUnresolvedSymbolFormat   = "unresolved symbol: %s"
+	messageCategories               = "keyboard categories: (send /category <name> to toggle)"
+	messageCategoryShownFormat      = "category shown: %s"
+	messageCategoryHiddenFormat     = "category hidden: %s"
+	messageNoSuchCategoryFormat     = "no such category: %s"
+	messageNoRecentException        = "no recent exception."
+	messageSessionsFormat           = "%d active session(s):"
+	messageSessionFormat            = "chat %d: idle for %s"
+	messageNotAllowed               = "you are not allowed to use this bot."
+	messageObserverOnly             = "observers can only view results."
+	messageInvalidCallback          = "invalid request."
+	messageConfirmLoadURLFormat     = "load %s ?"
+	messageURLExpired               = "this request has expired."
+	messageLoadURLCancelled         = "cancelled."
+	messageLoadURLCancelledFormat   = "cancelled loading %s"
+	messageURLLoadedFormat          = "loaded %s"
+	messageResetDone                = "reset."
+	messageRerunDone                = "re-ran."
+	messageUsageLength              = "usage: /length <n> (0 for unlimited)"
+	messagePrintLengthFormat        = "print length: %s"
+	messagePrintLengthDefaultFormat = "print length: %s (default)"
+	messageMessagesSuppressedFormat = "... output truncated, %d more message(s) suppressed."
+	messageSessionEnded             = "session ended. (next message will start a new one)"
+	messageDefinedFormat            = "✓ defined: %s"
+	messageBufferOn                 = "buffer mode on: messages will be buffered until /run."
+	messageBufferOff                = "buffer mode off: buffered messages were discarded."
+	messageBufferEmpty              = "nothing buffered. (send /buffer to start buffering)"
+	messageBufferedFormat           = "buffered. (%d characters, send /run to evaluate)"
+	messageNothingToDump            = "no definitions with source in the current namespace."
+	messagePreviewTruncatedFormat   = "\n… (%d more characters)"
+	messageFullResultExpired        = "the full result has expired."
+	messageFullResultSent           = "sent the full result."
+	messageNowFormat                = "bot: %s\nREPL: %s\nskew: %s (REPL - bot)"
+	messageFailedToGetReplTime      = "failed to get the time of REPL."
+	messageStopped                  = "stopped."
+	messageNothingToStop            = "nothing to stop."
+	messageEvalStopped              = "evaluation was stopped."
+	messageWaitingInput             = "waiting for an input: send a line (or /stop to cancel)"
+	messageReplLogDisabled          = "outputs of REPL are not captured. (enable `log_repl_output` in the config)"
+	messageNoReplLog                = "no outputs of REPL. (only outputs of REPL launched by this bot are captured)"
+	messageUsageReplLog             = "usage: /replog [number of lines]"
+	messageUsageType                = "usage: /type <form>"
+	messageTypeFormat               = "%s\ntype: %s"
+	messageDisabledInSafeMode       = "disabled in safe mode."
+	messageUsageMacroexpand         = "usage: /macroexpand <form> (or /macroexpand-1 <form>)"
+	messageMacroexpandMultipleForms = "only a single form can be expanded at once (got %d forms)"
+	messageUsageDeref               = "usage: /deref <form>"
+	messageNotDerefable             = "the result is not a reference type (eg. atom, ref, agent, var, delay, future, or promise)."
+	messageNothingToEvaluate        = "nothing to evaluate."
+	messageFormNotEvaluated         = "not evaluated: unbalanced or malformed form"
+	formLabelFormat                 = "[%d] %s\n"
+	messageNoTestsFormat            = "no tests in namespace: %s"
+	messageTestsSummaryFormat       = "%s: ran %s tests containing %s assertions, %d failures, %d errors."
+	messageTestsPassed              = "all tests passed."
+	messageTestsFailed              = "some tests failed. (press 'show more' for the details)"
+	messageVersionFormat            = "version: %s\ncommit: %s\nbuild date: %s\ngo: %s"
+	messageReportFormat             = "exception reported from chat %d:\n\n%s\n\n%s"
+	messageReported                 = "reported to the admin."
+	messageReportFailed             = "failed to report."
+	messageNamespacesFormat         = "%d namespaces loaded:\n%s"
+	messageUsageCapture             = "usage: /capture <form>"
+	messageNothingCaptured          = "nothing was printed."
+	messageUsageTranscript          = "usage: /transcript [clj|md] [time]"
+	messageNoHistory                = "no history to export yet."
+	messageNoPublics                = "no public definitions in this namespace."
+	messagePublicsFormat            = "%d public definitions:\n%s"
+	messagePublicsPageFormat        = "%d public definitions (page %d/%d):\n%s"
+	messagePageFormat               = "page %d"
+	messageUsageShell               = "usage: /shell <command> [arguments...]"
+	messageShellDisabled            = "shell is not enabled."
+	messageShellExitFormat          = "exit: %d"
+	messageShellStdoutFormat        = "stdout:\n%s"
+	messageShellStderrFormat        = "stderr:\n%s"
+	messageShellTimedOutFormat      = "timed out after %d seconds (the command may still be running)"
+	messageUsageEval                = "usage: /eval <form> (or reply to a message with /eval to evaluate its text)"
+
+	// flags in the caption of documents
+	captionFlagFile = "#file" // send results back as a file
+	captionFlagNs   = "#ns"   // load the file in given namespace (eg. `#ns my.ns`)
+
+	nowTimeFormat      = "2006-01-02 15:04:05.000 MST"
+	resultFilename     = "result.txt"
+	dumpFilenameFormat = "%s.clj"
+
+	// file extensions
+	extEdn  = ".edn"
+	extCljc = ".cljc"
+
+	errorConditionalReadNotAllowed = "Conditional read not allowed"
+
+	maxCompletions = 30
+	maxDocsLength  = 3000
+
+	docSeparator = "-------------------------"
+
+	namespacePrefixFormat = "[%s]\n"
+
+	// inline buttons and their callback data
+	buttonLoad            = "load"
+	buttonCancel          = "cancel"
+	callbackLoadURL       = "load"
+	callbackCancelLoadURL = "cancel"
+	callbackDataSeparator = ":"
+	buttonRerun           = "re-run"
+	buttonReset           = "reset"
+	buttonSource          = "source"
+	callbackRerun         = "rerun"
+	callbackReset         = "reset"
+	callbackSource        = "source"
+	buttonShowMore        = "show more"
+	callbackShowMore      = "more"
+	buttonReport          = "report"
+	callbackReport        = "report"
+	buttonPrevPage        = "< prev"
+	buttonNextPage        = "next >"
+	callbackPage          = "page"
+
+	valueNil = "nil"
+
+	// behaviors for unauthorized users
+	unauthorizedReply  = "reply"
+	unauthorizedSilent = "silent"
+
+	// behaviors for empty (or whitespace-only) inputs
+	emptyInputReply  = "reply"
+	emptyInputSilent = "silent"
+
+	// handling of outputs to stderr
+	stderrModeNone   = ""
+	stderrModePrefix = "prefix"
+	stderrModeFail   = "fail"
+	stderrPrefix     = "err: "
+)
+
+// errServerBusy is returned when there are too many evaluations in flight
+var errServerBusy = errors.New("server busy, try again later")
+
+// errUnbalanced is returned for codes with unbalanced delimiters (PREPL would keep waiting for the rest of them)
+var errUnbalanced = errors.New("unbalanced expression")
+
+// Config is a configuration of the bot
+type Config struct {
+	APIToken             string             `json:"api_token"`
+	ClojureBinPath       string             `json:"clojure_bin_path"`
+	ReplHost             string             `json:"repl_host"`
+	ReplPort             int                `json:"repl_port"`
+	OwnerID              string             `json:"owner_id,omitempty"` // always allowed, and has admin rights (regardless of allowed_ids and admin_ids)
+	AllowedIds           []string           `json:"allowed_ids"`
+	AdminIds             []string           `json:"admin_ids,omitempty"`
+	ObserverIds          []string           `json:"observer_ids,omitempty"`          // can see results in chats, but cannot evaluate
+	AllowedChatTypes     []string           `json:"allowed_chat_types,omitempty"`    // eg. ["private"] (all types are allowed if empty)
+	UnauthorizedBehavior string             `json:"unauthorized_behavior,omitempty"` // "reply" (default), "silent", or a custom message for unauthorized users
+	EmptyInputBehavior   string             `json:"empty_input_behavior,omitempty"`  // "reply" (default) or "silent" for empty (or whitespace-only) inputs
+	StartupRetries       int                `json:"startup_retries,omitempty"`       // retries of API calls on startup (eg. getMe) before giving up (default: 3)
+	MonitorInterval      int                `json:"monitor_interval"`
+	ReplIdleTimeout      int                `json:"repl_idle_timeout,omitempty"` // in seconds (0 for no timeout)
+	ShowKeyboard         *bool              `json:"show_keyboard,omitempty"`     // default: true
+	LazyRepl             bool               `json:"lazy_repl,omitempty"`         // connect to (or launch) REPL on the first evaluation
+	NeverLaunchRepl      bool               `json:"never_launch_repl,omitempty"` // only connect to an existing REPL (never launch one, eg. when it is managed externally)
+	MaxInputChars        int                `json:"max_input_chars,omitempty"`
+	MaxConcurrentEvals   int                `json:"max_concurrent_evals,omitempty"`    // evaluations in flight at once (0 for no limit)
+	MaxMessagesPerResult int                `json:"max_messages_per_result,omitempty"` // long results are split into messages up to this number (default: 5)
+	PreviewChars         int                `json:"preview_chars,omitempty"`           // send a preview of results longer than this (with a button for showing more), 0 for no previews
+	PublicsPageSize      int                `json:"publics_page_size,omitempty"`       // public definitions in a page of /publics (default: 100)
+	AuditLogPath         string             `json:"audit_log_path,omitempty"`
+	ShowNamespace        bool               `json:"show_namespace,omitempty"`        // prefix replies with the current namespace
+	ShowNamespacePrefix  *bool              `json:"show_namespace_prefix,omitempty"` // show `ns=>` before returned values (default: true)
+	CommandMessages      map[string]string  `json:"command_messages,omitempty"`      // messages for successful commands, keyed with command names (eg. {"reset": "namespace reset."})
+	Prompt               string             `json:"prompt,omitempty"`                // prompt between the namespace and returned value (default: "=> ")
+	ShowResultButtons    bool               `json:"show_result_buttons,omitempty"`   // attach inline buttons (re-run, reset, source) to results of evaluations
+	BoldErrors           bool               `json:"bold_errors,omitempty"`           // show exceptions in bold (only when output_format is not set)
+	ConfirmDefs          bool               `json:"confirm_defs,omitempty"`          // reply with a concise confirmation for definition forms (eg. `def`, `defn`)
+	SplitForms           bool               `json:"split_forms,omitempty"`           // evaluate top-level forms of a message one by one, with a numbered result for each
+	DefaultNamespace     string             `json:"default_namespace,omitempty"`     // namespace to start in (loaded if it is on the classpath, or created; not with `sandbox_namespaces`), default: "user"
+	SandboxNamespaces    bool               `json:"sandbox_namespaces,omitempty"`    // evaluate in a separate namespace for each chat
+	SafeMode             bool               `json:"safe_mode,omitempty"`             // disable loading files and reject forms which touch the filesystem or shell
+	EnableShell          bool               `json:"enable_shell,omitempty"`          // allow admins to run commands on the REPL host with /shell (not in safe mode)
+	InitForms            []string           `json:"init_forms,omitempty"`            // forms to evaluate in order on REPL initialization (default: require clojure.repl and set print length)
+	AutoRequire          []string           `json:"auto_require,omitempty"`          // namespaces to require on REPL initialization (eg. clojure.pprint)
+	OutputFormat         string             `json:"output_format,omitempty"`         // "markdown", "html", or empty for plain texts
+	StderrMode           string             `json:"stderr_mode,omitempty"`           // "prefix" for marking outputs to stderr, "fail" for also treating them as failures (default: same as stdout)
+	CollapseDuplicates   bool               `json:"collapse_duplicates,omitempty"`   // collapse identical consecutive outputs into one (eg. `hello (x2)`)
+	KeyboardCategories   []KeyboardCategory `json:"keyboard_categories,omitempty"`   // rows of the custom keyboard (each can be toggled with /category)
+	KeyboardInGroups     bool               `json:"keyboard_in_groups,omitempty"`    // show the keyboard also in group chats (default: only in private chats)
+	CommandScope         string             `json:"command_scope,omitempty"`         // scope of commands registered with Telegram: "default", "all_private_chats", "all_group_chats", or "none"
+	AdminChatID          int64              `json:"admin_chat_id,omitempty"`         // chat to receive exceptions reported with 'report' buttons (0 for not showing the buttons)
+	SessionIdleTimeout   int                `json:"session_idle_timeout,omitempty"`  // in seconds (0 for keeping sessions forever)
+	ReplyCacheSize       int                `json:"reply_cache_size,omitempty"`      // number of replies to remember per chat, for editing them when messages are edited (default: 100)
+	LogReplOutput        bool               `json:"log_repl_output,omitempty"`       // log outputs of the launched REPL process (and show them with /replog)
+	IsVerbose            bool               `json:"is_verbose,omitempty"`
+}
+
+// Validate checks required fields and ranges of values, and returns all problems as an error
+func (c Config) Validate() error {
+	errs := []error{}
+
+	if c.APIToken == "" {
+		errs = append(errs, fmt.Errorf("`api_token` is missing"))
+	}
+	if c.ReplHost == "" {
+		errs = append(errs, fmt.Errorf("`repl_host` is missing"))
+	}
+	if c.ReplPort < 1 || c.ReplPort > 65535 {
+		errs = append(errs, fmt.Errorf("`repl_port` should be in 1-65535 (got: %d)", c.ReplPort))
+	}
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"monitor_interval", c.MonitorInterval},
+		{"repl_idle_timeout", c.ReplIdleTimeout},
+		{"session_idle_timeout", c.SessionIdleTimeout},
+		{"max_input_chars", c.MaxInputChars},
+		{"max_messages_per_result", c.MaxMessagesPerResult},
+		{"max_concurrent_evals", c.MaxConcurrentEvals},
+		{"startup_retries", c.StartupRetries},
+		{"reply_cache_size", c.ReplyCacheSize},
+		{"publics_page_size", c.PublicsPageSize},
+	} {
+		if field.value < 0 {
+			errs = append(errs, fmt.Errorf("`%s` should not be negative (got: %d)", field.name, field.value))
+		}
+	}
+	switch strings.ToLower(c.OutputFormat) {
+	case outputFormatPlain, outputFormatMarkdown, outputFormatHTML:
+	default:
+		errs = append(errs, fmt.Errorf("`output_format` should be one of \"markdown\", \"html\", or empty (got: %s)", c.OutputFormat))
+	}
+	switch c.StderrMode {
+	case stderrModeNone, stderrModePrefix, stderrModeFail:
+	default:
+		errs = append(errs, fmt.Errorf("`stderr_mode` should be one of \"prefix\", \"fail\", or empty (got: %s)", c.StderrMode))
+	}
+	unsupported := []string{}
+	for name := range c.CommandMessages {
+		if _, exists := defaultCommandMessages["/"+name]; !exists {
+			unsupported = append(unsupported, name)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		errs = append(errs, fmt.Errorf("`command_messages` has unsupported commands: %s", strings.Join(unsupported, ", ")))
+	}
+	switch c.EmptyInputBehavior {
+	case "", emptyInputReply, emptyInputSilent:
+	default:
+		errs = append(errs, fmt.Errorf("`empty_input_behavior` should be one of \"reply\", \"silent\", or empty (got: %s)", c.EmptyInputBehavior))
+	}
+	switch telegram.BotCommandScopeType(c.CommandScope) {
+	case "", commandScopeNone, telegram.BotCommandScopeTypeDefault, telegram.BotCommandScopeTypeAllPrivateChats, telegram.BotCommandScopeTypeAllGroupChats:
+	default:
+		errs = append(errs, fmt.Errorf("`command_scope` is not supported (got: %s)", c.CommandScope))
+	}
+	if c.DefaultNamespace != "" && !repl.IsValidNamespace(c.DefaultNamespace) {
+		errs = append(errs, fmt.Errorf("`default_namespace` is not a valid namespace (got: %s)", c.DefaultNamespace))
+	}
+	if c.SandboxNamespaces && c.DefaultNamespace != "" && c.DefaultNamespace != defaultNamespace {
+		// (each chat is evaluated in its own sandbox namespace, so the default one would never be used)
+		errs = append(errs, fmt.Errorf("`default_namespace` cannot be used with `sandbox_namespaces` (got: %s)", c.DefaultNamespace))
+	}
+	for _, chatType := range c.AllowedChatTypes {
+		switch telegram.ChatType(chatType) {
+		case telegram.ChatTypePrivate, telegram.ChatTypeGroup, chatTypeSupergroup, telegram.ChatTypeChannel:
+		default:
+			errs = append(errs, fmt.Errorf("`allowed_chat_types` has an unknown chat type: %s", chatType))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// KeyboardCategory is a named row of command buttons in the custom keyboard
+type KeyboardCategory struct {
+	Name     string   `json:"name"`
+	Commands []string `json:"commands"`
+}
+
+// default layout of the custom keyboard
+var defaultKeyboardCategories = []KeyboardCategory{
+	{Name: "ns", Commands: []string{commandPublics, commandReset}},
+	{Name: "history", Commands: []string{commandLast, commandStatus}},
+}
+
+// Bot is a Telegram bot which evaluates received messages with Clojure REPL
+type Bot struct {
+	conf Config
+
+	api    *telegram.Bot
+	client *repl.Client
+
+	keyboardCategories []KeyboardCategory
+	sessions           *sessionManager
+	auditLogger        *auditLogger
+	formatter          formatter
+
+	startedAt  time.Time
+	adminChats map[int64]bool // ids of admins' private chats where admin commands are registered
+
+	printLengthOverridden bool   // whether any chat has overridden the print length or not
+	defaultPrintLength    string // print length before any override (eg. set with init forms), for chats without overrides
+
+	evalSlots     chan struct{} // semaphore for limiting concurrent evaluations (nil for no limit)
+	rejectedEvals int           // number of evaluations rejected due to the limit
+
+	cancel context.CancelFunc // for stopping `Run`
+	sync.Mutex
+}
+
+// New returns a new bot with given config
+func New(conf Config) (*Bot, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	if conf.MonitorInterval <= 0 {
+		conf.MonitorInterval = defaultMonitorInterval
+	}
+	if conf.MaxInputChars <= 0 {
+		conf.MaxInputChars = defaultMaxInputChars
+	}
+	if conf.Prompt == "" {
+		conf.Prompt = repl.DefaultPrompt
+	}
+	if conf.ReplyCacheSize <= 0 {
+		conf.ReplyCacheSize = defaultReplyCacheSize
+	}
+	if conf.PublicsPageSize <= 0 {
+		conf.PublicsPageSize = defaultPublicsPageSize
+	}
+	if conf.StartupRetries <= 0 {
+		conf.StartupRetries = defaultStartupRetries
+	}
+	if conf.MaxMessagesPerResult <= 0 {
+		conf.MaxMessagesPerResult = defaultMaxMessagesPerResult
+	}
+
+	// create a client (connected after it is configured, unless it is lazy)
+	var client *repl.Client
+	if conf.NeverLaunchRepl {
+		client = repl.NewLazyConnectOnlyClient(conf.ReplHost, conf.ReplPort)
+	} else {
+		client = repl.NewLazyClient(conf.ClojureBinPath, conf.ReplHost, conf.ReplPort)
+	}
+	client.Verbose = conf.IsVerbose
+	client.LogOutput = conf.LogReplOutput
+	initForms := conf.InitForms
+	if conf.DefaultNamespace != "" && conf.DefaultNamespace != defaultNamespace {
+		// enter the namespace first, so that init forms (eg. requires with `:refer`) are applied to it
+		if len(initForms) <= 0 {
+			initForms = repl.DefaultInitForms
+		}
+		initForms = append([]string{fmt.Sprintf(repl.CommandFormatEnterNs, conf.DefaultNamespace)}, initForms...)
+	}
+	if len(initForms) > 0 {
+		client.SetInitForms(initForms)
+	}
+	if len(conf.AutoRequire) > 0 {
+		client.SetAutoRequire(conf.AutoRequire)
+	}
+	if conf.ReplIdleTimeout > 0 {
+		client.SetIdleTimeout(time.Duration(conf.ReplIdleTimeout) * time.Second)
+	}
+
+	keyboardCategories := conf.KeyboardCategories
+	if len(keyboardCategories) <= 0 {
+		keyboardCategories = defaultKeyboardCategories
+	}
+
+	api := telegram.NewClient(conf.APIToken)
+	api.Verbose = conf.IsVerbose
+
+	b := &Bot{
+		conf: conf,
+
+		api:    api,
+		client: client,
+
+		keyboardCategories: keyboardCategories,
+		sessions:           newSessionManager(conf.ShowKeyboard == nil || *conf.ShowKeyboard, conf.ReplyCacheSize),
+		auditLogger:        newAuditLogger(conf.AuditLogPath, conf.OwnerID),
+		formatter:          newFormatter(conf.OutputFormat),
+
+		startedAt:  time.Now(),
+		adminChats: map[int64]bool{},
+	}
+	if conf.MaxConcurrentEvals > 0 {
+		b.evalSlots = make(chan struct{}, conf.MaxConcurrentEvals)
+	}
+
+	// restore namespaces of sessions after reconnection
+	client.SetRestorer(b.restoreForms)
+
+	if !conf.LazyRepl {
+		if err := client.Connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// forms for restoring namespaces of sessions after reconnection to PREPL
+//
+// (the most recently active session's namespace comes last, so it will be the current one)
+func (b *Bot) restoreForms() []string {
+	infos := b.sessions.list()
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].idle > infos[j].idle })
+
+	forms := []string{}
+	for _, info := range infos {
+		if b.conf.SandboxNamespaces {
+			if info.sandbox != "" {
+				forms = append(forms, fmt.Sprintf(repl.CommandFormatEnterSandbox, info.sandbox))
+			}
+		} else if info.namespace != "" && repl.IsValidNamespace(info.namespace) {
+			forms = append(forms, fmt.Sprintf(repl.CommandFormatRestoreNs, info.namespace))
+		}
+	}
+
+	return forms
+}
+
+// Run starts polling updates and handles them, until given context is done or `Stop` is called
+func (b *Bot) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b.Lock()
+	b.cancel = cancel
+	b.Unlock()
+
+	// get info about this bot
+	var me telegram.APIResponse[telegram.User]
+	if err := b.retryOnStartup(ctx, "get info of the bot", func() (bool, *string) {
+		me = b.api.GetMe()
+		return me.Ok, me.Description
+	}); err != nil {
+		return err
+	}
+	log.Printf("starting bot: @%s (%s)", *me.Result.Username, me.Result.FirstName)
+
+	// delete webhook (getting updates will not work when wehbook is set up)
+	if err := b.retryOnStartup(ctx, "delete webhook", func() (bool, *string) {
+		unhooked := b.api.DeleteWebhook(true)
+		return unhooked.Ok, unhooked.Description
+	}); err != nil {
+		return err
+	}
+
+	// clean up idle sessions
+	if b.conf.SessionIdleTimeout > 0 {
+		go b.reapIdleSessions(ctx, time.Duration(b.conf.SessionIdleTimeout)*time.Second)
+	}
+
+	// register commands for autocompletion
+	b.registerCommands()
+
+	// stop polling when the context is done
+	go func() {
+		<-ctx.Done()
+		b.api.StopPollingUpdates()
+	}()
+
+	// wait for new updates
+	b.api.StartPollingUpdates(0, b.conf.MonitorInterval, func(_ *telegram.Bot, update telegram.Update, err error) {
+		if err == nil {
+			b.handleUpdate(update)
+		} else {
+			log.Printf("error while receiving update: %s", err.Error())
+		}
+	})
+
+	return nil
+}
+
+// call given API function until it succeeds, with backoff (for transient failures of API on startup)
+func (b *Bot) retryOnStartup(ctx context.Context, what string, call func() (ok bool, description *string)) error {
+	delay := startupRetryBaseDelay
+	for i := 0; ; i++ {
+		ok, description := call()
+		if ok {
+			return nil
+		}
+
+		reason := "unknown reason"
+		if description != nil {
+			reason = *description
+		}
+		if i >= b.conf.StartupRetries {
+			return fmt.Errorf("failed to %s after %d retries: %s", what, b.conf.StartupRetries, reason)
+		}
+
+		log.Printf("failed to %s (%s), retrying in %s...", what, reason, delay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+			delay *= 2
+		}
+	}
+}
+
+// remove idle sessions (and their sandbox namespaces) periodically, until given context is done
+func (b *Bot) reapIdleSessions(ctx context.Context, timeout time.Duration) {
+	interval := sessionReapInterval
+	if timeout < interval {
+		interval = timeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, session := range b.sessions.expire(timeout) {
+				b.cleanUpSession(session)
+			}
+		}
+	}
+}
+
+// clean up resources of given (removed) session
+func (b *Bot) cleanUpSession(session *session) {
+	if ns := session.createdSandboxNamespace(); ns != "" && b.client.IsConnected() {
+		if _, err := b.evalDirectly(fmt.Sprintf(repl.CommandFormatRemoveNs, ns)); err != nil {
+			log.Printf("failed to remove namespace %s of a session: %s", ns, err)
+		}
+	}
+}
+
+// Stop stops running bot and shuts down its REPL client
+func (b *Bot) Stop() {
+	b.Lock()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.Unlock()
+
+	b.client.Shutdown()
+}
+
+// check if given Telegram id is the owner or not
+func (b *Bot) isOwnerID(id *string) bool {
+	return id != nil && b.conf.OwnerID != "" && *id == b.conf.OwnerID
+}
+
+// check if given Telegram id is allowed or not (the owner is always allowed)
+func (b *Bot) isAllowedID(id *string) bool {
+	if id == nil {
+		return false
+	}
+	if b.isOwnerID(id) {
+		return true
+	}
+
+	for _, v := range b.conf.AllowedIds {
+		if v == *id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check if given Telegram id is an admin or not (the owner is always an admin)
+func (b *Bot) isAdminID(id *string) bool {
+	if id == nil {
+		return false
+	}
+	if b.isOwnerID(id) {
+		return true
+	}
+
+	for _, v := range b.conf.AdminIds {
+		if v == *id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check if given Telegram id is an observer (who can see results, but cannot evaluate) or not
+func (b *Bot) isObserverID(id *string) bool {
+	if id == nil {
+		return false
+	}
+
+	for _, v := range b.conf.ObserverIds {
+		if v == *id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check if given type of chat is allowed or not (all types are allowed if not configured)
+func (b *Bot) isAllowedChatType(chatType telegram.ChatType) bool {
+	if len(b.conf.AllowedChatTypes) <= 0 {
+		return true
+	}
+
+	for _, v := range b.conf.AllowedChatTypes {
+		if telegram.ChatType(v) == chatType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handle received update from Telegram server
+func (b *Bot) handleUpdate(update telegram.Update) {
+	if update.HasMessage() || update.HasEditedMessage() {
+		var message *telegram.Message
+		var edited bool
+		if update.HasMessage() {
+			message = update.Message
+		} else { // if update.HasEditedMessage() {
+			message = update.EditedMessage
+			edited = true
+		}
+
+		// ignore messages from disallowed types of chats
+		if !b.isAllowedChatType(message.Chat.Type) {
+			if b.conf.IsVerbose {
+				log.Printf("ignoring a message from a disallowed type of chat: %s", message.Chat.Type)
+			}
+			return
+		}
+
+		var msg string
+		var evaluated bool // whether `msg` is a result of evaluation or not
+		var truncated bool // whether the full result of `msg` is saved for showing it with a 'show more' button
+		var buttons *telegram.InlineKeyboardMarkup
+		var entities []telegram.MessageEntity
+		username := message.From.Username
+		if !b.isAllowedID(username) && b.isObserverID(username) { // observers' messages are not evaluated
+			if b.conf.IsVerbose {
+				log.Printf("ignoring a message from an observer: @%s", *username)
+			}
+			return
+		} else if !b.isAllowedID(username) { // check if this user is allowed to use this bot
+			if username == nil {
+				log.Printf("received an update from an unauthorized user: '%s'", message.From.FirstName)
+
+				msg = fmt.Sprintf("'%s' is not allowed to use this bot.", message.From.FirstName)
+			} else {
+				log.Printf("received an update from an unauthorized user: @%s", *username)
+
+				msg = fmt.Sprintf("@%s is not allowed to use this bot.", *username)
+			}
+
+			switch b.conf.UnauthorizedBehavior {
+			case unauthorizedReply, "":
+				// do nothing (reply with the message above)
+			case unauthorizedSilent:
+				return
+			default: // custom message
+				msg = b.conf.UnauthorizedBehavior
+			}
+		} else {
+			if b.isOwnerID(username) {
+				log.Printf("[owner] received a message from the owner: @%s", *username)
+			}
+
+			// 'is typing...'
+			b.sendTyping(message)
+
+			// register admin commands in the private chat of an admin
+			if message.Chat.Type == telegram.ChatTypePrivate && b.isAdminID(username) && b.conf.CommandScope != commandScopeNone {
+				b.registerAdminCommands(message.Chat.ID)
+			}
+
+			if message.HasText() {
+				cmd, args := splitCommand(*message.Text)
+
+				buffering := b.sessions.get(message.Chat.ID).isBuffering()
+
+				if !isLocalCommand(cmd) && !(buffering && !strings.HasPrefix(cmd, "/")) {
+					b.notifyIfReplNotConnected(message)
+				}
+
+				switch cmd {
+				case commandStart:
+					msg = messageWelcome
+				case commandTranscript:
+					msg = b.sendTranscript(message, args)
+				case commandVersion:
+					msg = versionString()
+				case commandHelp:
+					msg = helpMessage(b.isAdminID(username))
+				case commandHideKeyboard:
+					b.sessions.get(message.Chat.ID).setKeyboardShown(false)
+					msg = b.commandMessage(commandHideKeyboard)
+				case commandShowKeyboard:
+					b.sessions.get(message.Chat.ID).setKeyboardShown(true)
+					msg = b.commandMessage(commandShowKeyboard)
+				case commandKeyboard:
+					b.sessions.get(message.Chat.ID).setSentKeyboard("") // for sending it again
+					msg = b.commandMessage(commandKeyboard)
+				case commandLength:
+					msg = b.printLength(message.Chat.ID, args)
+				case commandStop:
+					if b.sessions.get(message.Chat.ID).stopEvals() > 0 {
+						msg = b.commandMessage(commandStop)
+					} else {
+						msg = messageNothingToStop
+					}
+				case commandQuit:
+					if session, exists := b.sessions.remove(message.Chat.ID); exists {
+						b.cleanUpSession(session)
+					}
+					msg = b.commandMessage(commandQuit)
+				case commandCategory:
+					msg = b.toggleCategory(message.Chat.ID, args)
+				case commandLast:
+					n := 1
+					if args != "" {
+						if parsed, err := strconv.Atoi(args); err == nil {
+							n = parsed
+						} else {
+							n = 0
+						}
+					}
+
+					if item, exists := b.sessions.get(message.Chat.ID).nthLastHistory(n); exists {
+						msg = item.result
+					} else {
+						msg = messageNoSuchHistory
+					}
+				case commandMacroexpand, commandMacroexpand1:
+					if forms, rest := repl.SplitForms(args); len(forms) == 0 && rest == "" { // (empty, or only comments)
+						msg = messageUsageMacroexpand
+					} else if rest != "" {
+						msg = fmt.Sprintf("error: %s", errUnbalanced)
+					} else if len(forms) > 1 { // (`read-string` would read only the first one)
+						msg = fmt.Sprintf(messageMacroexpandMultipleForms, len(forms))
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatMacroexpand, strings.TrimPrefix(cmd, "/"), repl.QuoteString(args))
+						received, err := b.evalChecking(message.Chat.ID, code, args, nil)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							if repl.HasException(received) {
+								msg = b.respToString(received)
+							} else {
+								msg = strings.TrimSpace(printed(received))
+								entities = b.codeEntities(msg)
+							}
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandTest:
+					msg, truncated = b.runTests(message, args)
+				case commandCapture:
+					if args == "" {
+						msg = messageUsageCapture
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatCapture, args)
+						received, err := b.eval(message.Chat.ID, code)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							if captured, ok := capturedString(received); !ok {
+								msg = b.respToString(received)
+							} else if strings.TrimSpace(captured) == "" {
+								msg = messageNothingCaptured
+							} else {
+								msg = strings.TrimSpace(captured)
+								entities = b.codeEntities(msg)
+							}
+							b.sessions.get(message.Chat.ID).updateNamespace(received)
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandDeref:
+					if args == "" {
+						msg = messageUsageDeref
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatDeref, args) // (evaluated only once)
+						received, err := b.eval(message.Chat.ID, code)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							if returns(received, repl.ValueNotDerefable) {
+								msg = messageNotDerefable
+							} else {
+								msg = b.respToString(received)
+							}
+							b.sessions.get(message.Chat.ID).updateNamespace(received)
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandType:
+					if args == "" {
+						msg = messageUsageType
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatType, args) // (evaluated only once)
+						received, err := b.eval(message.Chat.ID, code)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							msg = b.respToString(received)
+							if !repl.HasException(received) {
+								if value, typ, ok := valueAndType(received); ok {
+									msg = fmt.Sprintf(messageTypeFormat, value, typ)
+								}
+							}
+							b.sessions.get(message.Chat.ID).updateNamespace(received)
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandAs:
+					name, form := splitFirstArg(args)
+
+					if name == "" || form == "" {
+						msg = messageUsageAs
+					} else if !repl.IsValidSymbol(name) {
+						msg = fmt.Sprintf(messageInvalidSymbolFormat, name)
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatDefAs, name, form)
+						received, err := b.eval(message.Chat.ID, code)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							msg = b.respToString(received)
+
+							if !repl.HasException(received) {
+								msg += "\n" + fmt.Sprintf(messageBoundFormat, name)
+							}
+
+							session := b.sessions.get(message.Chat.ID)
+							session.appendHistory(message.MessageID, form, msg)
+							session.updateNamespace(received)
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandDeps:
+					coord, version := splitFirstArg(args)
+
+					if !b.isAdminID(username) {
+						msg = messageAdminOnly
+					} else if b.conf.SafeMode {
+						msg = messageDisabledInSafeMode
+					} else if coord == "" || version == "" {
+						msg = messageUsageDeps
+					} else if !repl.IsValidLibCoord(coord) || !repl.IsValidLibVersion(version) {
+						msg = fmt.Sprintf(messageInvalidDepsFormat, coord, version)
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatAddLib, coord, version)
+						received, err := b.evalDirectly(code)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							if isUnsupported(received) {
+								msg = messageDepsUnsupported
+							} else if repl.HasException(received) {
+								msg = b.respToString(received)
+							} else {
+								msg = fmt.Sprintf(messageDepsAddedFormat, coord, version)
+							}
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandStatus:
+					msg = b.status(b.isAdminID(username))
+				case commandSessions:
+					if !b.isAdminID(username) {
+						msg = messageAdminOnly
+					} else {
+						msg = b.listSessions()
+					}
+				case commandShell:
+					if !b.isAdminID(username) {
+						msg = messageAdminOnly
+					} else if b.conf.SafeMode {
+						msg = messageDisabledInSafeMode
+					} else if !b.conf.EnableShell {
+						msg = messageShellDisabled
+					} else if args == "" {
+						msg = messageUsageShell
+					} else {
+						msg = b.runShell(message, args)
+					}
+				case commandReplLog:
+					if !b.isAdminID(username) {
+						msg = messageAdminOnly
+					} else {
+						msg = b.replLog(args)
+					}
+				case commandEval:
+					code := args
+					if code == "" && message.HasReplyTo() && message.ReplyToMessage.HasText() {
+						code = *message.ReplyToMessage.Text
+					}
+
+					if code == "" {
+						msg = messageUsageEval
+					} else if strings.TrimSpace(code) == "" {
+						if b.conf.EmptyInputBehavior == emptyInputSilent {
+							return
+						}
+						msg = messageNothingToEvaluate
+					} else if utf8.RuneCountInString(code) > b.conf.MaxInputChars {
+						msg = fmt.Sprintf(messageInputTooLongFormat, b.conf.MaxInputChars)
+					} else {
+						msg, entities = b.evaluate(message, code)
+						evaluated = true
+					}
+				case commandComplete:
+					if args == "" {
+						msg = messageUsageComplete
+					} else {
+						candidates, err := b.completions(args)
+						b.auditLogger.log(message, fmt.Sprintf(repl.CommandFormatCompletions, args), err != nil)
+
+						if err == nil {
+							if len(candidates) <= 0 {
+								msg = messageNoCompletions
+							} else if len(candidates) > maxCompletions {
+								msg = strings.Join(candidates[:maxCompletions], "\n") + "\n" +
+									fmt.Sprintf(messageMoreCompletionsFormat, len(candidates)-maxCompletions, len(candidates))
+							} else {
+								msg = strings.Join(candidates, "\n")
+							}
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandFindDoc:
+					if args == "" {
+						msg = messageUsageFindDoc
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatFindDoc, repl.QuoteString(args))
+						received, err := b.evalDirectly(code)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							if repl.HasException(received) {
+								msg = b.respToString(received)
+							} else {
+								msg = formatDocs(received)
+							}
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandMeta:
+					if args == "" {
+						msg = messageUsageMeta
+					} else if !repl.IsValidQualifiedSymbol(args) {
+						msg = fmt.Sprintf(messageInvalidSymbolFormat, args)
+					} else {
+						code := fmt.Sprintf(repl.CommandFormatMeta, args)
+						received, err := b.evalChecking(message.Chat.ID, code, args, nil)
+						b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+						if err == nil {
+							if repl.HasException(received) {
+								msg = b.respToString(received)
+							} else if returns(received, repl.ValueUnresolved) {
+								msg = fmt.Sprintf(messageUnresolvedSymbolFormat, args)
+							} else {
+								msg = printed(received)
+							}
+						} else {
+							msg = fmt.Sprintf("error: %s", err)
+						}
+					}
+				case commandPst:
+					received, err := b.eval(message.Chat.ID, repl.CommandPst)
+					b.auditLogger.log(message, repl.CommandPst, err != nil || b.failed(received))
+
+					if err == nil {
+						if returns(received, repl.ValueNoException) {
+							msg = messageNoRecentException
+						} else {
+							msg = strings.TrimSpace(printed(received))
+							entities = b.codeEntities(msg)
+						}
+					} else {
+						msg = fmt.Sprintf("error: %s", err)
+					}
+				case commandNow:
+					msg = b.now(message)
+				case commandDump:
+					received, err := b.eval(message.Chat.ID, repl.CommandDump)
+					b.auditLogger.log(message, repl.CommandDump, err != nil || b.failed(received))
+
+					if err == nil {
+						if repl.HasException(received) {
+							msg = b.respToString(received)
+						} else if source := printed(received); strings.TrimSpace(source) == "" {
+							msg = messageNothingToDump
+						} else {
+							ns := "user"
+							if len(received) > 0 && received[len(received)-1].Namespace != "" {
+								ns = received[len(received)-1].Namespace
+							}
+
+							if _, sent := b.sendDocument(message, fmt.Sprintf(dumpFilenameFormat, ns), []byte(source)); !sent {
+								msg = source
+							}
+						}
+					} else {
+						msg = fmt.Sprintf("error: %s", err)
+					}
+				case commandNamespaces:
+					received, err := b.eval(message.Chat.ID, repl.CommandNamespaces)
+					b.auditLogger.log(message, repl.CommandNamespaces, err != nil || b.failed(received))
+
+					if err == nil {
+						if repl.HasException(received) {
+							msg = b.respToString(received)
+						} else {
+							names := strings.Fields(printed(received))
+							msg = fmt.Sprintf(messageNamespacesFormat, len(names), strings.Join(names, "\n"))
+						}
+					} else {
+						msg = fmt.Sprintf("error: %s", err)
+					}
+				case commandPublics:
+					msg, buttons = b.listPublics(message)
+				case commandReset:
+					msg = b.reset(message)
+				case commandBuffer:
+					if b.sessions.get(message.Chat.ID).toggleBuffering() {
+						msg = messageBufferOn
+					} else {
+						msg = messageBufferOff
+					}
+				case commandRun:
+					if code := b.sessions.get(message.Chat.ID).flushBuffer(); strings.TrimSpace(code) == "" {
+						msg = messageBufferEmpty
+					} else if utf8.RuneCountInString(code) > b.conf.MaxInputChars {
+						msg = fmt.Sprintf(messageInputTooLongFormat, b.conf.MaxInputChars)
+					} else {
+						msg, entities = b.evaluate(message, code)
+						evaluated = true
+					}
+				default:
+					if b.sessions.get(message.Chat.ID).isWaitingInput() && !strings.HasPrefix(cmd, "/") {
+						msg = b.feedInput(message)
+					} else if buffering && !strings.HasPrefix(cmd, "/") {
+						length := b.sessions.get(message.Chat.ID).appendBuffer(*message.Text)
+						msg = fmt.Sprintf(messageBufferedFormat, length)
+					} else if strings.TrimSpace(*message.Text) == "" { // no need to send it to REPL
+						if b.conf.EmptyInputBehavior == emptyInputSilent {
+							return
+						}
+						msg = messageNothingToEvaluate
+					} else if utf8.RuneCountInString(*message.Text) > b.conf.MaxInputChars {
+						msg = fmt.Sprintf(messageInputTooLongFormat, b.conf.MaxInputChars)
+					} else if url, ok := loadableURL(*message.Text); ok {
+						if b.conf.SafeMode {
+							msg = messageDisabledInSafeMode
+						} else {
+							b.askToLoadURL(message, url)
+						}
+					} else {
+						msg, entities = b.evaluate(message, *message.Text)
+						evaluated = true
+					}
+				}
+			} else if message.HasDocument() && b.conf.SafeMode {
+				msg = messageDisabledInSafeMode
+			} else if message.HasDocument() && message.Document.FileSize > maxDownloadBytes {
+				msg = fmt.Sprintf("failed to download the document: file is too large (max: %d bytes)", maxDownloadBytes)
+			} else if message.HasDocument() {
+				b.notifyIfReplNotConnected(message)
+
+				// keep typing while downloading and loading the file, as it can take long
+				stopTyping := b.keepTyping(message)
+
+				// download the file (as temporary)
+				if fileResult := b.api.GetFile(message.Document.FileID); !fileResult.Ok || fileResult.Result == nil {
+					msg = fmt.Sprintf("failed to get the document: %s", describe(fileResult.Description))
+				} else if filepath, err := downloadTemporarily(b.api.GetFileURL(*fileResult.Result)); err == nil {
+					ext := strings.ToLower(path.Ext(filepath))
+					if message.Document.FileName != nil {
+						ext = strings.ToLower(path.Ext(*message.Document.FileName))
+					}
+
+					if msg, err = b.loadFile(message, filepath, ext); err == nil {
+						// send the result as a file, if requested with the caption
+						if hasCaptionFlag(message, captionFlagFile) {
+							if _, sent := b.sendDocument(message, resultFilename, []byte(msg)); sent {
+								msg = ""
+							}
+						}
+					} else {
+						msg = fmt.Sprintf("failed to load file: %s", err)
+					}
+				} else {
+					msg = fmt.Sprintf("failed to download the document: %s", err)
+				}
+
+				stopTyping()
+			} else {
+				msg = "error: couldn't process your message."
+			}
+
+			// prefix the current namespace
+			if b.conf.ShowNamespace && strings.TrimSpace(msg) != "" {
+				if ns := b.sessions.get(message.Chat.ID).currentNamespace(); ns != "" {
+					prefix := fmt.Sprintf(namespacePrefixFormat, ns)
+					msg = prefix + msg
+					entities = shiftEntities(entities, utf16Len(prefix))
+				}
+			}
+		}
+
+		// send a preview of large results
+		if evaluated && b.conf.PreviewChars > 0 {
+			msg, entities, truncated = b.previewResult(message, msg, entities)
+		}
+
+		// send message (or edit the previous reply, if the message was edited)
+		session := b.sessions.get(message.Chat.ID)
+		if evaluated && b.conf.ShowResultButtons {
+			buttons = resultButtons(message.MessageID)
+		}
+		if truncated {
+			buttons = withMoreButton(buttons, message.MessageID)
+		}
+		if evaluated && b.hasException(message) {
+			buttons = withReportButton(buttons, message.MessageID)
+		}
+		if edited {
+			if replyID, exists := session.replyTo(message.MessageID); exists {
+				b.editMessageWithMarkup(message, replyID, msg, buttons, entities)
+				return
+			}
+		}
+		var markup any
+		if buttons != nil {
+			markup = *buttons
+		} else {
+			markup = b.changedReplyMarkup(message.Chat)
+		}
+		if sentID, sent := b.sendMessageWithMarkup(message, msg, markup, entities); sent {
+			session.setReplyTo(message.MessageID, sentID)
+		}
+	} else if update.HasCallbackQuery() {
+		b.handleCallbackQuery(update.CallbackQuery)
+	} else {
+		log.Printf("received update has no processable message")
+	}
+}
+
+// rename given file to have given extension (if it does not have it yet), and return its path
+//
+// (returns the original path if it fails to rename)
+func ensureExtension(filepath, ext string) string {
+	if path.Ext(filepath) == ext { // (case-sensitive, as Clojure checks it so)
+		return filepath
+	}
+
+	if err := os.Rename(filepath, filepath+ext); err != nil {
+		log.Printf("failed to rename file %s: %s", filepath, err)
+
+		return filepath
+	}
+
+	return filepath + ext
+}
+
+// load (or read, if it is an .edn file) given file with REPL, and delete it
+func (b *Bot) loadFile(message *telegram.Message, filepath, ext string) (result string, err error) {
+	// `load-file` allows reader conditionals only in files with .cljc extension
+	if ext == extCljc {
+		filepath = ensureExtension(filepath, extCljc)
+	}
+
+	var received []repl.Response
+	isEdn := ext == extEdn
+	if err = b.acquireEvalSlot(); err == nil {
+		if isEdn { // read .edn files as data
+			received, err = b.client.ReadEdnFile(filepath)
+		} else if ns, exists := captionFlagValue(message, captionFlagNs); exists {
+			received, err = b.client.LoadFileInNamespace(filepath, ns)
+		} else {
+			received, err = b.client.LoadFile(filepath)
+		}
+
+		b.releaseEvalSlot()
+	}
+	b.sessions.get(message.Chat.ID).updateNamespace(received)
+	b.auditLogger.log(message, fmt.Sprintf("(load-file %q)", filepath), err != nil || b.failed(received))
+
+	// delete the file
+	if err := os.Remove(filepath); err != nil {
+		log.Printf("failed to delete file %s: %s", filepath, err)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	result = b.respToString(received)
+	if isEdn && repl.HasException(received) {
+		result = fmt.Sprintf(messageFailedToParseEdnFormat, result)
+	} else if strings.Contains(result, errorConditionalReadNotAllowed) {
+		result += messageHintReaderConditionals
+	}
+
+	return result, nil
+}
+
+// inline buttons for the result of given message id
+func resultButtons(messageID int64) *telegram.InlineKeyboardMarkup {
+	id := strconv.FormatInt(messageID, 10)
+
+	markup := telegram.NewInlineKeyboardMarkup([][]telegram.InlineKeyboardButton{
+		{
+			telegram.NewInlineKeyboardButton(buttonRerun).SetCallbackData(callbackRerun + callbackDataSeparator + id),
+			telegram.NewInlineKeyboardButton(buttonReset).SetCallbackData(callbackReset + callbackDataSeparator + id),
+			telegram.NewInlineKeyboardButton(buttonSource).SetCallbackData(callbackSource + callbackDataSeparator + id),
+		},
+	})
+
+	return &markup
+}
+
+// re-run or show the source of evaluated code, with the result message
+func (b *Bot) handleResultButton(message *telegram.Message, action, arg string) (answer string) {
+	messageID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return messageInvalidCallback
+	}
+
+	item, exists := b.sessions.get(message.Chat.ID).historyOf(messageID)
+	if !exists {
+		return messageNoSuchHistory
+	}
+
+	// the message which contained the code
+	origin := message
+	if message.ReplyToMessage != nil {
+		origin = message.ReplyToMessage
+	}
+
+	switch action {
+	case callbackRerun:
+		result, entities := b.evaluate(origin, item.code)
+		b.sendMessageWithMarkup(origin, result, *resultButtons(origin.MessageID), entities)
+		return messageRerunDone
+	default: // callbackSource
+		b.sendMessage(message, item.code)
+		return ""
+	}
+}
+
+// send given text as a reply to the message
+func (b *Bot) sendMessage(message *telegram.Message, text string) (sentMessageID int64, sent bool) {
+	return b.sendMessageWithMarkup(message, text, b.changedReplyMarkup(message.Chat), nil)
+}
+
+// send given text as a reply to the message, with given reply markup and message entities (can be nil)
+//
+// (long text is split into chunks, and chunks over `MaxMessagesPerResult` are suppressed)
+func (b *Bot) sendMessageWithMarkup(message *telegram.Message, text string, markup any, entities []telegram.MessageEntity) (sentMessageID int64, sent bool) {
+	text, entities = trimStyled(repl.ValidUTF8(text), entities) // (texts with invalid UTF-8 sequences are rejected)
+	if text == "" {
+		return 0, false
+	}
+
+	chunks := splitStyled(text, entities, maxMessageLength)
+	if len(chunks) > b.conf.MaxMessagesPerResult {
+		suppressed := len(chunks) - b.conf.MaxMessagesPerResult
+		chunks = append(chunks[:b.conf.MaxMessagesPerResult], styledText{
+			text: fmt.Sprintf(messageMessagesSuppressedFormat, suppressed),
+		})
+	}
+
+	for i, chunk := range chunks {
+		options := telegram.OptionsSendMessage{}.
+			SetReplyParameters(telegram.NewReplyParameters(message.MessageID))
+		if threadID, exists := topicThreadID(message); exists {
+			options = options.SetMessageThreadID(threadID)
+		}
+		if i == len(chunks)-1 && markup != nil { // reply markup only on the last one
+			options = options.SetReplyMarkup(markup)
+		}
+		if b.formatter.parseMode != nil {
+			options = options.SetParseMode(*b.formatter.parseMode)
+		} else if len(chunk.entities) > 0 {
+			options = options.SetEntities(chunk.entities)
+		}
+
+		res := sendWithRetry("message", func() telegram.APIResponse[telegram.Message] {
+			return b.api.SendMessage(message.Chat.ID, b.formatter.format(chunk.text), options)
+		})
+		if !res.Ok {
+			break
+		}
+		if i == len(chunks)-1 {
+			b.keyboardSent(message.Chat.ID, markup)
+		}
+
+		if !sent { // return the id of the first one
+			sentMessageID, sent = res.Result.MessageID, true
+		}
+	}
+
+	return sentMessageID, sent
+}
+
+// send given content as a document file (named `filename`) as a reply to the message
+func (b *Bot) sendDocument(message *telegram.Message, filename string, content []byte) (sentMessageID int64, sent bool) {
+	// write content to a temporary file, so that it can be sent with its filename
+	dir, err := os.MkdirTemp(tempDir, "result-")
+	if err != nil {
+		log.Printf("failed to create temporary directory: %s", err)
+		return 0, false
+	}
+	defer os.RemoveAll(dir)
+
+	filepath := path.Join(dir, filename)
+	if err := os.WriteFile(filepath, content, 0644); err != nil {
+		log.Printf("failed to write file %s: %s", filepath, err)
+		return 0, false
+	}
+
+	options := telegram.OptionsSendDocument{}.
+		SetReplyParameters(telegram.NewReplyParameters(message.MessageID))
+	if threadID, exists := topicThreadID(message); exists {
+		options = options.SetMessageThreadID(threadID)
+	}
+	markup := b.changedReplyMarkup(message.Chat)
+	if markup != nil {
+		options = options.SetReplyMarkup(markup)
+	}
+
+	res := sendWithRetry("document", func() telegram.APIResponse[telegram.Message] {
+		return b.api.SendDocument(message.Chat.ID, telegram.NewInputFileFromFilepath(filepath), options)
+	})
+	if res.Ok {
+		b.keyboardSent(message.Chat.ID, markup)
+
+		return res.Result.MessageID, true
+	}
+
+	return 0, false
+}
+
+// send 'typing' chat action to the chat (and forum topic) of given message
+func (b *Bot) sendTyping(message *telegram.Message) {
+	options := telegram.OptionsSendChatAction{}
+	if threadID, exists := topicThreadID(message); exists {
+		options = options.SetMessageThreadID(threadID)
+	}
+	sendWithRetry("chat action", func() telegram.APIResponse[bool] {
+		return b.api.SendChatAction(message.Chat.ID, telegram.ChatActionTyping, options)
+	})
+}
+
+// send 'typing' chat action periodically until the returned function is called (for long tasks)
+func (b *Bot) keepTyping(message *telegram.Message) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(chatActionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				b.sendTyping(message)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// id of the forum topic (thread) of given message, for sending messages or actions to the same topic
+func topicThreadID(message *telegram.Message) (threadID int64, exists bool) {
+	if message.IsTopicMessage != nil && *message.IsTopicMessage && message.MessageThreadID != nil {
+		return *message.MessageThreadID, true
+	}
+
+	return 0, false
+}
+
+// value of a flag in the caption of given message (eg. `my.ns` of `#ns my.ns`)
+func captionFlagValue(message *telegram.Message, flag string) (value string, exists bool) {
+	if !message.HasCaption() {
+		return "", false
+	}
+
+	fields := strings.Fields(*message.Caption)
+	for i, field := range fields {
+		if field == flag && i+1 < len(fields) {
+			return fields[i+1], true
+		}
+	}
+
+	return "", false
+}
+
+// check if the caption of given message has a flag
+func hasCaptionFlag(message *telegram.Message, flag string) bool {
+	if !message.HasCaption() {
+		return false
+	}
+
+	for _, field := range strings.Fields(*message.Caption) {
+		if field == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// edit the text of a message which was sent previously
+func (b *Bot) editMessage(message *telegram.Message, text string) {
+	b.editMessageWithMarkup(message, message.MessageID, text, nil, nil)
+}
+
+// edit the text of a message (with `messageID`) in the chat of given message,
+// with given inline keyboard markup and message entities (can be nil)
+//
+// (text over the length limit is sent as new messages replying to given message, as editing it would fail)
+func (b *Bot) editMessageWithMarkup(message *telegram.Message, messageID int64, text string, markup *telegram.InlineKeyboardMarkup, entities []telegram.MessageEntity) {
+	text, entities = trimStyled(repl.ValidUTF8(text), entities) // (texts with invalid UTF-8 sequences are rejected)
+	if text == "" {
+		return
+	}
+
+	chunks := splitStyled(text, entities, maxMessageLength)
+	first := chunks[0]
+
+	options := telegram.OptionsEditMessageText{}.
+		SetIDs(message.Chat.ID, messageID)
+	if markup != nil && len(chunks) == 1 { // inline keyboard markup only on the last one
+		options = options.SetReplyMarkup(*markup)
+	}
+	if b.formatter.parseMode != nil {
+		options = options.SetParseMode(*b.formatter.parseMode)
+	} else if len(first.entities) > 0 {
+		options = options.SetEntities(first.entities)
+	}
+
+	if edited := sendWithRetry("edited message", func() telegram.APIResponse[bool] {
+		res := b.api.EditMessageText(b.formatter.format(first.text), options)
+		return telegram.APIResponse[bool]{Ok: res.Ok, Description: res.Description, Parameters: res.Parameters}
+	}); !edited.Ok {
+		return
+	}
+
+	// send the rest as new messages
+	if len(chunks) > 1 {
+		var restMarkup any
+		if markup != nil {
+			restMarkup = *markup
+		}
+
+		b.sendMessageWithMarkup(message, text[len(first.text):], restMarkup, clipEntities(entities, utf16Len(first.text), utf16Len(text)))
+	}
+}
+
+// commands which are handled without REPL
+var localCommands = []string{
+	commandStart,
+	commandHideKeyboard,
+	commandShowKeyboard,
+	commandKeyboard,
+	commandLast,
+	commandStatus,
+	commandCategory,
+	commandHelp,
+	commandSessions,
+	commandLength,
+	commandQuit,
+	commandVersion,
+	commandTranscript,
+	commandBuffer,
+	commandStop,
+	commandReplLog,
+}
+
+// check if given command is handled without REPL
+func isLocalCommand(cmd string) bool {
+	for _, c := range localCommands {
+		if c == cmd {
+			return true
+		}
+	}
+
+	return false
+}
+
+// list active sessions with their idle times
+func (b *Bot) listSessions() string {
+	infos := b.sessions.list()
+
+	lines := []string{fmt.Sprintf(messageSessionsFormat, len(infos))}
+	for _, info := range infos {
+		lines = append(lines, fmt.Sprintf(messageSessionFormat, info.chatID, info.idle.Round(time.Second)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// status of REPL (with its latency) and uptime of this bot
+//
+// (address of REPL is included only when `detailed` is true)
+func (b *Bot) status(detailed bool) string {
+	var lines []string
+
+	state := messageReplNotConnected
+	if b.client.IsConnected() {
+		state = messageReplConnected
+	}
+	if detailed {
+		state = fmt.Sprintf("%s (%s)", state, net.JoinHostPort(b.conf.ReplHost, strconv.Itoa(b.conf.ReplPort)))
+	}
+	lines = append(lines, fmt.Sprintf(messageStatusReplFormat, state))
+
+	if rtt, err := b.client.Ping(context.Background()); err == nil {
+		lines = append(lines, fmt.Sprintf(messageStatusLatencyFormat, float64(rtt.Microseconds())/1000))
+	}
+
+	lines = append(lines, fmt.Sprintf(messageStatusUptimeFormat, time.Since(b.startedAt).Round(time.Second)))
+
+	if b.evalSlots != nil {
+		b.Lock()
+		rejected := b.rejectedEvals
+		b.Unlock()
+
+		lines = append(lines, fmt.Sprintf(messageStatusEvalsFormat, len(b.evalSlots), cap(b.evalSlots), rejected))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// last lines of outputs of the launched REPL process
+func (b *Bot) replLog(args string) string {
+	if !b.conf.LogReplOutput {
+		return messageReplLogDisabled
+	}
+
+	n := defaultReplLogLines
+	if args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n <= 0 {
+			return messageUsageReplLog
+		}
+	}
+
+	lines := b.client.ProcessOutputs(n)
+	if len(lines) <= 0 {
+		return messageNoReplLog
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// notify the user that REPL is starting (or being connected to, if launching is disabled), if it is not connected yet
+func (b *Bot) notifyIfReplNotConnected(message *telegram.Message) {
+	if !b.client.IsConnected() {
+		if b.conf.NeverLaunchRepl {
+			b.sendMessage(message, messageConnectingRepl)
+		} else {
+			b.sendMessage(message, messageStartingRepl)
+		}
+	}
+}
+
+// convert responses to output parts (with or without the namespace prefix, as configured)
+func (b *Bot) respToParts(responses []repl.Response) []repl.OutputPart {
+	parts := repl.RespToParts(responses)
+	if b.conf.ShowNamespacePrefix != nil && !*b.conf.ShowNamespacePrefix {
+		parts = repl.BareParts(parts)
+	}
+	if b.conf.CollapseDuplicates {
+		parts = repl.CollapseDuplicateParts(parts)
+	}
+	if b.conf.StderrMode != stderrModeNone {
+		for i, part := range parts {
+			if part.Type == repl.Stderr && part.Text != "" {
+				parts[i].Text = stderrPrefix + part.Text
+				if b.conf.StderrMode == stderrModeFail { // (shown like exceptions)
+					parts[i].Type = repl.Exception
+				}
+			}
+		}
+	}
+
+	return parts
+}
+
+// check if given responses are of a failed evaluation
+// (includes outputs to stderr, if configured)
+func (b *Bot) failed(responses []repl.Response) bool {
+	return repl.HasException(responses) || (b.conf.StderrMode == stderrModeFail && repl.HasStderr(responses))
+}
+
+// convert responses to string (with or without the namespace prefix, as configured)
+func (b *Bot) respToString(responses []repl.Response) string {
+	return repl.PartsToStringWithPrompt(b.respToParts(responses), b.conf.Prompt)
+}
+
+// convert responses to string, with bold entities for exceptions (if configured, and no parse mode is used)
+func (b *Bot) respToStyledString(responses []repl.Response) (string, []telegram.MessageEntity) {
+	parts := b.respToParts(responses)
+	if !b.conf.BoldErrors || b.formatter.parseMode != nil {
+		return repl.PartsToStringWithPrompt(parts, b.conf.Prompt), nil
+	}
+
+	return styledParts(parts, b.conf.Prompt)
+}
+
+// evaluate given code in the chat's namespace (its sandbox namespace, if enabled),
+// with its own print length (if any chat has overridden it)
+func (b *Bot) eval(chatID int64, code string) (responses []repl.Response, err error) {
+	return b.evalChecking(chatID, code, code, nil)
+}
+
+// evaluate given code like `eval`, with given input token (see `watchForInput`)
+func (b *Bot) evalReading(chatID int64, code string, input *repl.InputToken) (responses []repl.Response, err error) {
+	return b.evalChecking(chatID, code, code, input)
+}
+
+// evaluate given code like `eval`, but check only `userCode` (the part of `code` from the user) in safe mode
+// (for codes which are wrapped with trusted forms, eg. `read-string` of /macroexpand or `resolve` of /meta)
+func (b *Bot) evalChecking(chatID int64, code, userCode string, input *repl.InputToken) (responses []repl.Response, err error) {
+	if err = b.checkSafe(userCode); err != nil {
+		return nil, err
+	}
+	if !repl.Balanced(code) {
+		return nil, errUnbalanced
+	}
+
+	if err = b.acquireEvalSlot(); err != nil {
+		return nil, err
+	}
+	defer b.releaseEvalSlot()
+
+	session := b.sessions.get(chatID)
+
+	// can be cancelled with /stop
+	ctx, finish := session.startEval()
+	defer finish()
+	if input != nil {
+		ctx = repl.WithInputToken(ctx, input)
+	}
+
+	setups := []string{}
+	if b.isPrintLengthOverridden() {
+		length := session.printLengthOverride()
+		if length == "" {
+			length = b.overriddenDefaultPrintLength()
+		}
+		setups = append(setups, fmt.Sprintf(repl.CommandFormatSetPrintLength, length))
+	}
+	if b.conf.SandboxNamespaces {
+		setups = append(setups, fmt.Sprintf(repl.CommandFormatEnterSandbox, session.sandboxNamespace()))
+	}
+
+	if len(setups) > 0 {
+		return b.client.EvalAfter(ctx, "(do "+strings.Join(setups, " ")+")", code)
+	}
+
+	return b.client.EvalContext(ctx, code)
+}
+
+// evaluate given code with the client as it is (not in the chat's namespace), in a slot of evaluation
+func (b *Bot) evalDirectly(code string) (responses []repl.Response, err error) {
+	if err = b.acquireEvalSlot(); err != nil {
+		return nil, err
+	}
+	defer b.releaseEvalSlot()
+
+	return b.client.Eval(code)
+}
+
+// completion candidates for given prefix, in a slot of evaluation
+func (b *Bot) completions(prefix string) (candidates []string, err error) {
+	if err = b.acquireEvalSlot(); err != nil {
+		return nil, err
+	}
+	defer b.releaseEvalSlot()
+
+	return b.client.Completions(prefix)
+}
+
+// wait for a free slot of evaluation (for `evalQueueTimeoutSeconds` at most)
+func (b *Bot) acquireEvalSlot() error {
+	if b.evalSlots == nil {
+		return nil
+	}
+
+	select {
+	case b.evalSlots <- struct{}{}:
+		return nil
+	case <-time.After(evalQueueTimeoutSeconds * time.Second):
+		b.Lock()
+		b.rejectedEvals++
+		rejected := b.rejectedEvals
+		b.Unlock()
+
+		log.Printf("rejected an evaluation: too many evaluations in flight (total %d rejected)", rejected)
+
+		return errServerBusy
+	}
+}
+
+// release the acquired slot of evaluation
+func (b *Bot) releaseEvalSlot() {
+	if b.evalSlots != nil {
+		<-b.evalSlots
+	}
+}
+
+// check if any chat has overridden the print length
+func (b *Bot) isPrintLengthOverridden() bool {
+	b.Lock()
+	overridden := b.printLengthOverridden
+	b.Unlock()
+
+	return overridden
+}
+
+// print length before any override, which is remembered on the first override
+func (b *Bot) overriddenDefaultPrintLength() string {
+	b.Lock()
+	length := b.defaultPrintLength
+	b.Unlock()
+
+	return length
+}
+
+// current print length of REPL (eg. set with init forms), or the default one if it cannot be read
+func (b *Bot) replPrintLength() string {
+	if received, err := b.evalDirectly(repl.CommandPrintLength); err == nil && !repl.HasException(received) {
+		for _, r := range received {
+			if r.Tag == "ret" {
+				return strings.TrimSpace(r.Value)
+			}
+		}
+	}
+
+	return repl.DefaultPrintLength
+}
+
+// show or set the print length of given chat
+func (b *Bot) printLength(chatID int64, args string) string {
+	session := b.sessions.get(chatID)
+
+	if args == "" {
+		if length := session.printLengthOverride(); length != "" {
+			return fmt.Sprintf(messagePrintLengthFormat, length)
+		}
+
+		length := b.overriddenDefaultPrintLength()
+		if length == "" { // (not overridden by any chat yet)
+			length = b.replPrintLength()
+		}
+
+		return fmt.Sprintf(messagePrintLengthDefaultFormat, length)
+	}
+
+	length := args
+	if length != valueNil {
+		if n, err := strconv.Atoi(length); err != nil || n < 0 {
+			return messageUsageLength
+		} else if n == 0 {
+			length = valueNil
+		}
+	}
+
+	// remember the print length before the first override, for restoring it in other chats
+	if !b.isPrintLengthOverridden() {
+		defaultLength := b.replPrintLength()
+
+		b.Lock()
+		if b.defaultPrintLength == "" {
+			b.defaultPrintLength = defaultLength
+		}
+		b.Unlock()
+	}
+
+	session.setPrintLengthOverride(length)
+
+	b.Lock()
+	b.printLengthOverridden = true
+	b.Unlock()
+
+	return fmt.Sprintf(messagePrintLengthFormat, length)
+}
+
+// reset the namespace of given message's chat
+func (b *Bot) reset(message *telegram.Message) string {
+	if b.conf.SandboxNamespaces {
+		return b.resetSandbox(message)
+	}
+
+	received, err := b.evalDirectly(repl.CommandReset)
+	b.auditLogger.log(message, repl.CommandReset, err != nil || b.failed(received))
+
+	if err == nil {
+		if len(received) <= 0 {
+			return messageErrorNothingReceived
+		} else if repl.HasException(received) {
+			return b.respToString(received)
+		}
+
+		return b.commandMessage(commandReset)
+	}
+
+	return messageFailedToReset
+}
+
+// remove the sandbox namespace of given message's chat (a fresh one will be created on the next evaluation)
+func (b *Bot) resetSandbox(message *telegram.Message) string {
+	session := b.sessions.get(message.Chat.ID)
+	ns := session.sandboxNamespace()
+
+	code := fmt.Sprintf(repl.CommandFormatRemoveNs, ns)
+	received, err := b.evalDirectly(code)
+	b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+	if err == nil {
+		if repl.HasException(received) {
+			return b.respToString(received)
+		}
+		session.discardSandboxNamespace()
+
+		return b.commandMessage(commandReset)
+	}
+
+	return messageFailedToReset
+}
+
+// evaluate given code and return its result as a string (also appended to the history and audit log)
+func (b *Bot) evaluate(message *telegram.Message, code string) (result string, entities []telegram.MessageEntity) {
+	if b.conf.SplitForms {
+		if forms, rest := repl.SplitForms(code); len(forms) > 1 || (len(forms) > 0 && rest != "") {
+			return b.evaluateForms(message, code, forms, rest)
+		}
+	}
+
+	input, finished := b.watchForInput(message, code)
+	received, err := b.evalReading(message.Chat.ID, code, input)
+	finished()
+	if err == nil {
+		result, entities = b.evaluated(message, received)
+
+		b.sessions.get(message.Chat.ID).appendHistory(message.MessageID, code, result)
+	} else if errors.Is(err, context.Canceled) { // stopped with /stop
+		result = messageEvalStopped
+	} else {
+		result = fmt.Sprintf("error: %s", err)
+	}
+
+	b.auditLogger.log(message, code, err != nil || b.failed(received))
+
+	return result, entities
+}
+
+// result of given responses of an evaluation for given message
+// (a confirmation for definitions, or a returned image file sent as a photo, if configured)
+//
+// (also updates the chat's namespace, and saves the exception for reporting)
+func (b *Bot) evaluated(message *telegram.Message, received []repl.Response) (result string, entities []telegram.MessageEntity) {
+	var names []string
+	var defined bool
+	if b.conf.ConfirmDefs {
+		names, defined = definedNames(received)
+	}
+
+	if defined {
+		result = fmt.Sprintf(messageDefinedFormat, strings.Join(names, ", "))
+	} else if path, ok := imageFile(received); ok && !b.conf.SafeMode && b.sendPhoto(message, path) {
+		result = printed(received) // (the returned value was sent as a photo)
+	} else {
+		result, entities = b.respToStyledString(received)
+	}
+
+	b.sessions.get(message.Chat.ID).updateNamespace(received)
+	b.saveException(message, received)
+
+	return result, entities
+}
+
+// format docs printed by `find-doc` (with the number of matches, truncated if too long)
+func formatDocs(responses []repl.Response) string {
+	docs := []string{}
+	for _, part := range repl.RespToParts(responses) {
+		if part.Type == repl.Stdout || part.Type == repl.Stderr {
+			docs = append(docs, part.Text)
+		}
+	}
+	joined := strings.TrimSpace(strings.Join(docs, "\n"))
+
+	count := strings.Count(joined, docSeparator)
+	if count <= 0 {
+		return messageNoDocsFound
+	}
+
+	if runes := []rune(joined); len(runes) > maxDocsLength {
+		joined = string(runes[:maxDocsLength]) + messageTruncated
+	}
+
+	return fmt.Sprintf(messageDocsFoundFormat, count, joined)
+}
+
+// check if given responses tell that the evaluated command is not supported
+func isUnsupported(responses []repl.Response) bool {
+	return returns(responses, repl.ValueUnsupported)
+}
+
+// times of the bot host and REPL (JVM), with the skew between them
+func (b *Bot) now(message *telegram.Message) string {
+	requested := time.Now()
+	received, err := b.eval(message.Chat.ID, repl.CommandNow)
+	b.auditLogger.log(message, repl.CommandNow, err != nil || b.failed(received))
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	}
+	responded := time.Now()
+
+	for _, r := range received {
+		if r.Tag != "ret" || r.Exception {
+			continue
+		}
+
+		var value []any
+		if err := edn.Unmarshal([]byte(r.Value), &value); err == nil && len(value) == 2 {
+			millis, isInt := value[0].(int64)
+			zone, isString := value[1].(string)
+			if !isInt || !isString {
+				break
+			}
+
+			botTime := requested.Add(responded.Sub(requested) / 2) // (the middle of the round trip)
+			replTime := time.UnixMilli(millis)
+			if location, err := time.LoadLocation(zone); err == nil {
+				replTime = replTime.In(location)
+			}
+
+			return fmt.Sprintf(messageNowFormat,
+				botTime.Format(nowTimeFormat),
+				replTime.Format(nowTimeFormat),
+				replTime.Sub(botTime).Round(time.Millisecond))
+		}
+	}
+
+	return messageFailedToGetReplTime
+}
+
+// printed value and type from the returned value of `repl.CommandFormatType`
+func valueAndType(responses []repl.Response) (value, typ string, ok bool) {
+	for _, r := range responses {
+		if r.Tag == "ret" {
+			var pair []string
+			if err := edn.Unmarshal([]byte(r.Value), &pair); err == nil && len(pair) == 2 {
+				return pair[0], pair[1], true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// returned string of `with-out-str` in given responses
+func capturedString(responses []repl.Response) (captured string, ok bool) {
+	if repl.HasException(responses) {
+		return "", false
+	}
+
+	for _, r := range responses {
+		if r.Tag == "ret" {
+			if err := edn.Unmarshal([]byte(r.Value), &captured); err == nil {
+				return captured, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// check if given responses include a returned value which is equal to `value`
+func returns(responses []repl.Response, value string) bool {
+	for _, r := range responses {
+		if r.Tag == "ret" && strings.TrimSpace(r.Value) == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// regular expression for definition forms (eg. `(defn f [x] x)`)
+var reDefForm = regexp.MustCompile(`^\(\s*(?:[a-zA-Z0-9_.-]+/)?(?:def|defn|defn-|defmacro|defonce|defmulti|defprotocol|defrecord|deftype|defstruct)\s+(?:\^\S+\s+)*([^\s()\[\]{}"^]+)`)
+
+// names of definitions, if given responses are all from successful definition forms (with nothing printed)
+func definedNames(responses []repl.Response) (names []string, ok bool) {
+	for _, r := range responses {
+		if r.Tag != "ret" || r.Exception {
+			return nil, false
+		}
+
+		matches := reDefForm.FindStringSubmatch(strings.TrimSpace(r.Form))
+		if matches == nil {
+			return nil, false
+		}
+		names = append(names, matches[1])
+	}
+
+	return names, len(names) > 0
+}
+
+// concatenate printed (stdout and stderr) parts of given responses
+func printed(responses []repl.Response) string {
+	var sb strings.Builder
+
+	for _, part := range repl.RespToParts(responses) {
+		if part.Type == repl.Stdout || part.Type == repl.Stderr {
+			sb.WriteString(part.Text)
+			sb.WriteString("\n")
+		}
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// split given text into a command (without bot's username) and its arguments
+func splitCommand(text string) (cmd, args string) {
+	text = strings.TrimSpace(text)
+
+	if !strings.HasPrefix(text, "/") {
+		return "", text
+	}
+
+	cmd, args = splitFirstArg(text)
+	cmd, _, _ = strings.Cut(cmd, "@") // strip bot's username (eg. /command@some_bot)
+
+	return cmd, args
+}
+
+// split given arguments into the first one and the rest
+func splitFirstArg(args string) (first, rest string) {
+	if i := strings.IndexFunc(args, unicode.IsSpace); i >= 0 {
+		return args[:i], strings.TrimSpace(args[i:])
+	}
+
+	return args, ""
+}
+
+// reply markup for given chat id (show or remove keyboards)
+func (b *Bot) replyMarkup(chatID int64) any {
+	session := b.sessions.get(chatID)
+
+	if session.isKeyboardShown() {
+		keyboards := [][]telegram.KeyboardButton{}
+		for _, category := range b.keyboardCategories {
+			if session.isCategoryHidden(category.Name) || len(category.Commands) <= 0 {
+				continue
+			}
+
+			row := []telegram.KeyboardButton{}
+			for _, cmd := range category.Commands {
+				row = append(row, telegram.NewKeyboardButton(cmd))
+			}
+			keyboards = append(keyboards, row)
+		}
+
+		if len(keyboards) > 0 {
+			return telegram.NewReplyKeyboardMarkup(keyboards).
+				SetResizeKeyboard(true)
+		}
+	}
+
+	return telegram.NewReplyKeyboardRemove(true)
+}
+
+// reply markup for given chat, only when it was not sent yet or has changed since the last one (nil otherwise)
+//
+// (sending the same keyboard with every message is wasteful, and makes it flicker on some clients)
+func (b *Bot) changedReplyMarkup(chat telegram.Chat) any {
+	// keyboards are for private chats, unless enabled for groups
+	if chat.Type != telegram.ChatTypePrivate && !b.conf.KeyboardInGroups {
+		return nil
+	}
+
+	markup := b.replyMarkup(chat.ID)
+
+	serialized, err := json.Marshal(markup)
+	if err != nil {
+		return markup
+	}
+
+	if b.sessions.get(chat.ID).lastSentKeyboard() == string(serialized) {
+		return nil
+	}
+
+	return markup
+}
+
+// remember given reply markup as the last sent one of the chat (called only after it was sent successfully)
+//
+// (inline keyboards are not remembered, as they do not replace custom keyboards)
+func (b *Bot) keyboardSent(chatID int64, markup any) {
+	switch markup.(type) {
+	case telegram.ReplyKeyboardMarkup, telegram.ReplyKeyboardRemove:
+		if serialized, err := json.Marshal(markup); err == nil {
+			b.sessions.get(chatID).setSentKeyboard(string(serialized))
+		}
+	}
+}
+
+// list keyboard categories (with their visibility in given chat), or toggle the one with given name
+func (b *Bot) toggleCategory(chatID int64, name string) string {
+	session := b.sessions.get(chatID)
+
+	if name == "" {
+		lines := []string{messageCategories}
+		for _, category := range b.keyboardCategories {
+			check := "[x]"
+			if session.isCategoryHidden(category.Name) {
+				check = "[ ]"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s: %s", check, category.Name, strings.Join(category.Commands, " ")))
+		}
+
+		return strings.Join(lines, "\n")
+	}
+
+	for _, category := range b.keyboardCategories {
+		if category.Name == name {
+			if session.toggleCategory(name) {
+				return fmt.Sprintf(messageCategoryHiddenFormat, name)
+			}
+
+			return fmt.Sprintf(messageCategoryShownFormat, name)
+		}
+	}
+
+	return fmt.Sprintf(messageNoSuchCategoryFormat, name)
+}
+
+// download given url
+func downloadTemporarily(url string) (filepath string, err error) {
+	tokens := strings.Split(url, "/")
+	filename := reUnsafeFilenameChars.ReplaceAllString(tokens[len(tokens)-1], "_") // get the last path segment
+
+	var f *os.File
+	if f, err = os.CreateTemp(tempDir, "*-"+filename); err == nil {
+		defer f.Close()
+		filepath = f.Name()
+
+		var response *http.Response
+		if response, err = httpClient.Get(url); err == nil {
+			defer response.Body.Close()
+
+			if response.StatusCode != http.StatusOK {
+				err = fmt.Errorf("http status %d", response.StatusCode)
+			} else {
+				var written int64
+				if written, err = io.Copy(f, io.LimitReader(response.Body, maxDownloadBytes+1)); err == nil {
+					if written <= maxDownloadBytes {
+						return filepath, nil
+					}
+
+					err = fmt.Errorf("file is too large (max: %d bytes)", maxDownloadBytes)
+				}
+			}
+		}
+
+		_ = os.Remove(filepath)
+	}
+
+	return "", err
+}
+
+// regular expression for characters which are not safe in file names
+var reUnsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// http client for downloading files
+var httpClient = &http.Client{Timeout: downloadTimeoutSeconds * time.Second}
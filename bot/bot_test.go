@@ -0,0 +1,100 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+func TestEnsureExtension(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{filename: "123-test", expected: "123-test.cljc"},
+		{filename: "123-test.clj", expected: "123-test.clj.cljc"},
+		{filename: "123-test.cljc", expected: "123-test.cljc"},
+		{filename: "123-test.CLJC", expected: "123-test.CLJC.cljc"},
+	}
+
+	for _, test := range tests {
+		original := filepath.Join(dir, test.filename)
+		if err := os.WriteFile(original, []byte(`#?(:clj 1)`), 0o600); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+
+		renamed := ensureExtension(original, extCljc)
+		if expected := filepath.Join(dir, test.expected); renamed != expected {
+			t.Errorf("ensureExtension(%s) = %s, expected %s", test.filename, renamed, expected)
+		}
+		if _, err := os.Stat(renamed); err != nil {
+			t.Errorf("renamed file does not exist: %s", err)
+		}
+
+		_ = os.Remove(renamed)
+	}
+
+	// (keeps the original path when it fails to rename)
+	missing := filepath.Join(dir, "missing")
+	if renamed := ensureExtension(missing, extCljc); renamed != missing {
+		t.Errorf("expected the original path on failure, got %s", renamed)
+	}
+}
+
+func TestChangedReplyMarkup(t *testing.T) {
+	b := &Bot{
+		sessions:           newSessionManager(true, 10),
+		keyboardCategories: defaultKeyboardCategories,
+	}
+	chat := telegram.Chat{ID: 1, Type: telegram.ChatTypePrivate}
+
+	markup := b.changedReplyMarkup(chat)
+	if markup == nil {
+		t.Fatalf("expected a keyboard which was not sent yet")
+	}
+
+	// (not remembered until it is sent successfully, eg. when sending failed)
+	if b.changedReplyMarkup(chat) == nil {
+		t.Errorf("expected the keyboard to be sent again, as it was not sent")
+	}
+
+	// (inline keyboards do not replace custom keyboards)
+	b.keyboardSent(chat.ID, telegram.NewInlineKeyboardMarkup([][]telegram.InlineKeyboardButton{}))
+	if b.changedReplyMarkup(chat) == nil {
+		t.Errorf("expected the keyboard to be sent again, as only an inline keyboard was sent")
+	}
+
+	b.keyboardSent(chat.ID, markup)
+	if b.changedReplyMarkup(chat) != nil {
+		t.Errorf("expected no keyboard, as it was sent already")
+	}
+
+	// (changed keyboards are sent again)
+	b.sessions.get(chat.ID).setKeyboardShown(false)
+	if b.changedReplyMarkup(chat) == nil {
+		t.Errorf("expected a changed keyboard")
+	}
+}
+
+func TestValidateDefaultNamespaceWithSandbox(t *testing.T) {
+	conf := Config{
+		APIToken:          "token",
+		ReplHost:          "localhost",
+		ReplPort:          8888,
+		DefaultNamespace:  "my.app",
+		SandboxNamespaces: true,
+	}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "`default_namespace` cannot be used with `sandbox_namespaces`") {
+		t.Errorf("expected an error for `default_namespace` with `sandbox_namespaces`, got: %v", err)
+	}
+
+	conf.SandboxNamespaces = false
+	if err := conf.Validate(); err != nil && strings.Contains(err.Error(), "`default_namespace`") {
+		t.Errorf("unexpected error for `default_namespace`: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package bot
+
+// handling callback queries from inline buttons
+
+import (
+	"log"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+// callbackHandler handles a callback query with the message of its inline button,
+// and the argument of its data, and returns the text for answering it
+type callbackHandler func(b *Bot, message *telegram.Message, arg string) (answer string)
+
+// callback handlers, keyed by the prefix of callback data (eg. "rerun" for "rerun:1234")
+var callbackHandlers = map[string]callbackHandler{
+	callbackLoadURL: func(b *Bot, message *telegram.Message, arg string) string {
+		return b.loadPendingURL(message, arg, false)
+	},
+	callbackCancelLoadURL: func(b *Bot, message *telegram.Message, arg string) string {
+		return b.loadPendingURL(message, arg, true)
+	},
+	callbackRerun: func(b *Bot, message *telegram.Message, arg string) string {
+		return b.handleResultButton(message, callbackRerun, arg)
+	},
+	callbackSource: func(b *Bot, message *telegram.Message, arg string) string {
+		return b.handleResultButton(message, callbackSource, arg)
+	},
+	callbackShowMore: func(b *Bot, message *telegram.Message, arg string) string {
+		return b.showMore(message, arg)
+	},
+	callbackReport: func(b *Bot, message *telegram.Message, arg string) string {
+		return b.reportException(message, arg)
+	},
+	callbackPage: func(b *Bot, message *telegram.Message, arg string) string {
+		return b.turnPage(message, arg)
+	},
+	callbackReset: func(b *Bot, message *telegram.Message, _ string) string {
+		b.sendMessage(message, b.reset(message))
+		return messageResetDone
+	},
+}
+
+// handle callback query from inline buttons
+func (b *Bot) handleCallbackQuery(query *telegram.CallbackQuery) {
+	var answer string
+
+	if !b.isAllowedID(query.From.Username) && b.isObserverID(query.From.Username) { // observers cannot evaluate
+		answer = messageObserverOnly
+	} else if !b.isAllowedID(query.From.Username) { // check if this user is allowed to use this bot
+		if query.From.Username == nil {
+			log.Printf("received a callback query from an unauthorized user: '%s'", query.From.FirstName)
+		} else {
+			log.Printf("received a callback query from an unauthorized user: @%s", *query.From.Username)
+		}
+
+		answer = messageNotAllowed
+	} else if query.Message == nil || query.Data == nil {
+		answer = messageInvalidCallback
+	} else if message, _ := query.Message.AsMessage(); message == nil { // message is too old
+		answer = messageInvalidCallback
+	} else {
+		prefix, arg, _ := strings.Cut(*query.Data, callbackDataSeparator)
+
+		if handler, exists := callbackHandlers[prefix]; exists {
+			answer = handler(b, message, arg)
+		} else {
+			log.Printf("no handler for callback data: %s", *query.Data)
+
+			answer = messageInvalidCallback
+		}
+	}
+
+	sendWithRetry("answer to callback query", func() telegram.APIResponse[bool] {
+		return b.api.AnswerCallbackQuery(query.ID, telegram.OptionsAnswerCallbackQuery{}.SetText(answer))
+	})
+}
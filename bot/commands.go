@@ -0,0 +1,165 @@
+package bot
+
+// commands of the bot (for /help and registering them with Telegram)
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	commandScopeNone = "none" // for not registering commands
+)
+
+// botCommand is a command of this bot with its description
+type botCommand struct {
+	command     string
+	description string
+	adminOnly   bool
+}
+
+// commands of this bot, in the order of listing
+var botCommands = []botCommand{
+	{command: commandHelp, description: "show available commands"},
+	{command: commandPublics, description: "list public definitions of the current namespace"},
+	{command: commandNamespaces, description: "list loaded namespaces"},
+	{command: commandReset, description: "unmap definitions of the current namespace"},
+	{command: commandTranscript, description: "export the history as a file (eg. /transcript md time)"},
+	{command: commandLast, description: "show the n-th last result (eg. /last 2)"},
+	{command: commandAs, description: "bind the result of a form to a name (eg. /as x (+ 1 2))"},
+	{command: commandEval, description: "evaluate a form (or the text of the replied message)"},
+	{command: commandBuffer, description: "toggle buffer mode (messages are evaluated at once with /run)"},
+	{command: commandRun, description: "evaluate buffered messages at once"},
+	{command: commandComplete, description: "list completions for a prefix"},
+	{command: commandFindDoc, description: "search docs with a pattern"},
+	{command: commandMacroexpand, description: "expand a macro form (eg. /macroexpand (when x y))"},
+	{command: commandMacroexpand1, description: "expand a macro form once"},
+	{command: commandTest, description: "run tests of a namespace (or the current one) and show a summary"},
+	{command: commandCapture, description: "show what a form prints, captured with with-out-str"},
+	{command: commandDeref, description: "show the value of a reference type (eg. /deref (atom 1))"},
+	{command: commandType, description: "show a value with its type (eg. /type (range 3))"},
+	{command: commandMeta, description: "show metadata of a var"},
+	{command: commandDump, description: "download source codes of definitions in the current namespace as a file"},
+	{command: commandPst, description: "print the stack trace of the last exception"},
+	{command: commandLength, description: "show or set the print length (0 for unlimited)"},
+	{command: commandStop, description: "stop evaluations in flight"},
+	{command: commandQuit, description: "end this chat's session and start clean"},
+	{command: commandNow, description: "show times of the bot and REPL (for checking clock skew)"},
+	{command: commandVersion, description: "show build information of the bot"},
+	{command: commandStatus, description: "show the status of REPL"},
+	{command: commandCategory, description: "list or toggle keyboard categories"},
+	{command: commandHideKeyboard, description: "hide the keyboard"},
+	{command: commandShowKeyboard, description: "show the keyboard"},
+	{command: commandKeyboard, description: "send the keyboard again"},
+	{command: commandDeps, description: "add a library at runtime (eg. /deps org.clojure/data.json 2.5.0)", adminOnly: true},
+	{command: commandSessions, description: "list active sessions", adminOnly: true},
+	{command: commandShell, description: "run a command on the REPL host (eg. /shell uptime), if enabled", adminOnly: true},
+	{command: commandReplLog, description: "show the last lines of outputs of REPL (eg. /replog 50)", adminOnly: true},
+}
+
+// default messages for successful commands which have no values to show (can be overridden with `command_messages`)
+var defaultCommandMessages = map[string]string{
+	commandReset:        messageNamespaceReset,
+	commandStop:         messageStopped,
+	commandQuit:         messageSessionEnded,
+	commandHideKeyboard: messageKeyboardHidden,
+	commandShowKeyboard: messageKeyboardShown,
+	commandKeyboard:     messageKeyboardResent,
+}
+
+// message for the successful result of given command
+func (b *Bot) commandMessage(command string) string {
+	if msg, exists := b.conf.CommandMessages[strings.TrimPrefix(command, "/")]; exists {
+		return msg
+	}
+
+	return defaultCommandMessages[command]
+}
+
+// regular expression for command names which can be registered with Telegram
+var reRegistrableCommand = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// help message with available commands
+func helpMessage(isAdmin bool) string {
+	lines := []string{}
+	for _, c := range botCommands {
+		if c.adminOnly && !isAdmin {
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("%s - %s", c.command, c.description))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// commands for registering with Telegram
+func registrableCommands(includeAdminOnly bool) []telegram.BotCommand {
+	commands := []telegram.BotCommand{}
+	for _, c := range botCommands {
+		if c.adminOnly && !includeAdminOnly {
+			continue
+		}
+
+		name := strings.TrimPrefix(c.command, "/")
+		if !reRegistrableCommand.MatchString(name) { // eg. `/find-doc`
+			continue
+		}
+
+		commands = append(commands, telegram.BotCommand{
+			Command:     name,
+			Description: c.description,
+		})
+	}
+
+	return commands
+}
+
+// register commands (without admin-only ones) with Telegram in the configured scope, for autocompletion
+func (b *Bot) registerCommands() {
+	scope := telegram.BotCommandScopeType(b.conf.CommandScope)
+	switch scope {
+	case commandScopeNone:
+		return
+	case "":
+		scope = telegram.BotCommandScopeTypeDefault
+	case telegram.BotCommandScopeTypeDefault,
+		telegram.BotCommandScopeTypeAllPrivateChats,
+		telegram.BotCommandScopeTypeAllGroupChats:
+		// do nothing
+	default:
+		log.Printf("unsupported command scope: %s", scope)
+		return
+	}
+
+	sendWithRetry("commands", func() telegram.APIResponse[bool] {
+		return b.api.SetMyCommands(registrableCommands(false), telegram.OptionsSetMyCommands{}.
+			SetScope(telegram.BotCommandScopeDefault{Type: scope}))
+	})
+}
+
+// register all commands (including admin-only ones) with Telegram, for the private chat of an admin
+//
+// (admins are identified with their usernames, so it can only be done after receiving their messages)
+func (b *Bot) registerAdminCommands(chatID int64) {
+	b.Lock()
+	registered := b.adminChats[chatID]
+	b.adminChats[chatID] = true
+	b.Unlock()
+
+	if registered {
+		return
+	}
+
+	sendWithRetry(fmt.Sprintf("admin commands for chat %d", chatID), func() telegram.APIResponse[bool] {
+		return b.api.SetMyCommands(registrableCommands(true), telegram.OptionsSetMyCommands{}.
+			SetScope(telegram.BotCommandScopeChat{
+				BotCommandScopeDefault: telegram.BotCommandScopeDefault{Type: telegram.BotCommandScopeTypeChat},
+				ChatID:                 chatID,
+			}))
+	})
+}
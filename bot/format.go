@@ -0,0 +1,191 @@
+package bot
+
+// formatting of messages (with parse modes or message entities)
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+// output formats
+const (
+	outputFormatPlain    = ""
+	outputFormatMarkdown = "markdown"
+	outputFormatHTML     = "html"
+)
+
+// formatter formats texts for sending them with its parse mode
+//
+// (whole texts are escaped and wrapped in code blocks, so user-derived contents like names,
+// echoed forms, or error messages can be interpolated into messages without escaping them)
+type formatter struct {
+	parseMode *telegram.ParseMode // nil for plain texts
+	format    func(text string) string
+}
+
+// newFormatter returns a formatter for given output format (plain if it is unknown)
+func newFormatter(outputFormat string) formatter {
+	switch strings.ToLower(outputFormat) {
+	case outputFormatPlain:
+		return formatter{format: func(text string) string { return text }}
+	case outputFormatMarkdown:
+		parseMode := telegram.ParseModeMarkdownV2
+		return formatter{parseMode: &parseMode, format: formatMarkdown}
+	case outputFormatHTML:
+		parseMode := telegram.ParseModeHTML
+		return formatter{parseMode: &parseMode, format: formatHTML}
+	default:
+		log.Printf("unknown output format: %s, falling back to plain text", outputFormat)
+
+		return newFormatter(outputFormatPlain)
+	}
+}
+
+// wrap given text in a code block of MarkdownV2
+func formatMarkdown(text string) string {
+	return fmt.Sprintf("```\n%s\n```", escapeMarkdownCode(text))
+}
+
+// wrap given text in a code block of HTML
+func formatHTML(text string) string {
+	return fmt.Sprintf("<pre><code>%s</code></pre>", escapeHTML(text))
+}
+
+// escape given text for placing it in a code block of MarkdownV2
+// (only '`' and '\' need to be escaped there)
+func escapeMarkdownCode(text string) string {
+	text = strings.ReplaceAll(text, "\\", "\\\\")
+	text = strings.ReplaceAll(text, "`", "\\`")
+
+	return text
+}
+
+// escape given text for HTML (eg. '<', '>', '&')
+func escapeHTML(text string) string {
+	return html.EscapeString(text)
+}
+
+// join given output parts as a string (with given prompt), with bold entities for exceptions
+func styledParts(parts []repl.OutputPart, prompt string) (text string, entities []telegram.MessageEntity) {
+	offset := 0
+	for i, part := range parts {
+		if i > 0 {
+			offset++ // for the newline
+		}
+
+		str := part.StringWithPrompt(prompt)
+		length := utf16Len(str)
+		if part.Type == repl.Exception && length > 0 {
+			entities = append(entities, telegram.MessageEntity{
+				Type:   telegram.MessageEntityTypeBold,
+				Offset: offset,
+				Length: length,
+			})
+		}
+		offset += length
+	}
+
+	return repl.PartsToStringWithPrompt(parts, prompt), entities
+}
+
+// message entities for showing given text as a code block
+// (nil when a parse mode is used, as texts are already wrapped in code blocks)
+func (b *Bot) codeEntities(text string) []telegram.MessageEntity {
+	if b.formatter.parseMode != nil || text == "" {
+		return nil
+	}
+
+	return []telegram.MessageEntity{{
+		Type:   telegram.MessageEntityTypePre,
+		Offset: 0,
+		Length: utf16Len(text),
+	}}
+}
+
+// length of given string in UTF-16 code units (offsets and lengths of message entities are counted in them)
+func utf16Len(str string) int {
+	return len(utf16.Encode([]rune(str)))
+}
+
+// shift offsets of given message entities
+func shiftEntities(entities []telegram.MessageEntity, shift int) []telegram.MessageEntity {
+	shifted := []telegram.MessageEntity{}
+	for _, e := range entities {
+		e.Offset += shift
+		if e.Offset >= 0 {
+			shifted = append(shifted, e)
+		}
+	}
+
+	return shifted
+}
+
+// trim spaces of given text, keeping its message entities in place
+func trimStyled(text string, entities []telegram.MessageEntity) (string, []telegram.MessageEntity) {
+	trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+	if len(entities) > 0 {
+		entities = shiftEntities(entities, utf16Len(trimmed)-utf16Len(text))
+	}
+	trimmed = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+
+	return trimmed, clipEntities(entities, 0, utf16Len(trimmed))
+}
+
+// clip given message entities to the range of [from, to) (in UTF-16 code units), and shift them by `-from`
+func clipEntities(entities []telegram.MessageEntity, from, to int) []telegram.MessageEntity {
+	clipped := []telegram.MessageEntity{}
+	for _, e := range entities {
+		start, end := max(e.Offset, from), min(e.Offset+e.Length, to)
+		if start < end {
+			e.Offset, e.Length = start-from, end-start
+			clipped = append(clipped, e)
+		}
+	}
+
+	return clipped
+}
+
+// styledText is a text with its message entities
+type styledText struct {
+	text     string
+	entities []telegram.MessageEntity
+}
+
+// split given text into chunks of `maxLen` runes at most (at newlines, if possible),
+// with their message entities
+func splitStyled(text string, entities []telegram.MessageEntity, maxLen int) (chunks []styledText) {
+	runes := []rune(text)
+
+	offset := 0 // in UTF-16 code units
+	for len(runes) > 0 {
+		n := len(runes)
+		if n > maxLen {
+			n = maxLen
+			for i := maxLen - 1; i > maxLen/2; i-- { // split at the last newline in the latter half
+				if runes[i] == '\n' {
+					n = i + 1
+					break
+				}
+			}
+		}
+
+		chunk := string(runes[:n])
+		length := utf16Len(chunk)
+		chunks = append(chunks, styledText{
+			text:     chunk,
+			entities: clipEntities(entities, offset, offset+length),
+		})
+
+		runes = runes[n:]
+		offset += length
+	}
+
+	return chunks
+}
@@ -0,0 +1,47 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestFormatMarkdown(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{text: `(+ 1 2)`, expected: "```\n(+ 1 2)\n```"},
+		// (only '`' and '\' are escaped in code blocks)
+		{text: `*print-length*`, expected: "```\n*print-length*\n```"},
+		{text: `my_fn_name`, expected: "```\nmy_fn_name\n```"},
+		{text: `(< 1 2)`, expected: "```\n(< 1 2)\n```"},
+		{text: "`(inc 1)", expected: "```\n\\`(inc 1)\n```"},
+		{text: `"a\nb"`, expected: "```\n\"a\\\\nb\"\n```"},
+		{text: "```", expected: "```\n\\`\\`\\`\n```"},
+	}
+
+	for _, test := range tests {
+		if formatted := formatMarkdown(test.text); formatted != test.expected {
+			t.Errorf("formatMarkdown(%q) = %q, expected %q", test.text, formatted, test.expected)
+		}
+	}
+}
+
+func TestFormatHTML(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{text: `(+ 1 2)`, expected: `<pre><code>(+ 1 2)</code></pre>`},
+		{text: `*print-length*`, expected: `<pre><code>*print-length*</code></pre>`},
+		{text: `my_fn_name`, expected: `<pre><code>my_fn_name</code></pre>`},
+		{text: `(< 1 2)`, expected: `<pre><code>(&lt; 1 2)</code></pre>`},
+		{text: `(-> x (str "&" ">"))`, expected: `<pre><code>(-&gt; x (str &#34;&amp;&#34; &#34;&gt;&#34;))</code></pre>`},
+		{text: `</code></pre><b>`, expected: `<pre><code>&lt;/code&gt;&lt;/pre&gt;&lt;b&gt;</code></pre>`},
+	}
+
+	for _, test := range tests {
+		if formatted := formatHTML(test.text); formatted != test.expected {
+			t.Errorf("formatHTML(%q) = %q, expected %q", test.text, formatted, test.expected)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package bot
+
+// sending returned images as photos
+//
+// When the returned value of an evaluation is a `java.io.File` of an image (.png, .jpg, .jpeg, or .gif),
+// eg. `(java.io.File. "/tmp/plot.png")`, the file is sent as a photo instead of the printed value.
+// (REPL should be on the same machine as the bot, for the bot to read the file)
+
+import (
+	"os"
+	"regexp"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+const (
+	maxPhotoBytes = 10 * 1024 * 1024 // 10 MB (limit of Telegram)
+)
+
+// regular expression for printed `java.io.File`s of images, after being cleansed by the client
+// (eg. `#object[java.io.File 0x1b2c3d4e "/tmp/plot.png"]` => `[java.io.File "0x1b2c3d4e" "/tmp/plot.png"]`)
+var reImageFile = regexp.MustCompile(`^\[java\.io\.File "0x[0-9a-fA-F]+" "([^"]+\.(?i:png|jpe?g|gif))"\]$`)
+
+// path of the image file which was returned in given responses
+func imageFile(responses []repl.Response) (path string, ok bool) {
+	for _, r := range responses {
+		if r.Tag == "ret" && !r.Exception {
+			if matches := reImageFile.FindStringSubmatch(r.Value); len(matches) == 2 {
+				if info, err := os.Stat(matches[1]); err == nil && info.Mode().IsRegular() && info.Size() <= maxPhotoBytes {
+					return matches[1], true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
+
+// send the image file at given path as a photo, as a reply to the message
+func (b *Bot) sendPhoto(message *telegram.Message, path string) (sent bool) {
+	options := telegram.OptionsSendPhoto{}.
+		SetReplyParameters(telegram.NewReplyParameters(message.MessageID))
+	if threadID, exists := topicThreadID(message); exists {
+		options = options.SetMessageThreadID(threadID)
+	}
+	markup := b.changedReplyMarkup(message.Chat)
+	if markup != nil {
+		options = options.SetReplyMarkup(markup)
+	}
+
+	if res := sendWithRetry("photo "+path, func() telegram.APIResponse[telegram.Message] {
+		return b.api.SendPhoto(message.Chat.ID, telegram.NewInputFileFromFilepath(path), options)
+	}); !res.Ok {
+		return false
+	}
+	b.keyboardSent(message.Chat.ID, markup)
+
+	return true
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/meinside/telegram-clojure-repl-bot/internal/prepltest"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+func TestImageFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plot.png")
+	if err := os.WriteFile(path, []byte("\x89PNG\r\n\x1a\n"), 0o600); err != nil {
+		t.Fatalf("failed to write image file: %s", err)
+	}
+
+	// (responses of PREPL are cleansed by the client before being decoded)
+	server, err := prepltest.NewServer(map[string]string{
+		`(java.io.File. "plot.png")`: fmt.Sprintf(`{:tag :ret, :val "#object[java.io.File 0x1b2c3d4e \"%s\"]", :ns "user", :ms 0, :form "(java.io.File. \"plot.png\")"}`, path),
+		`(java.io.File. "none.png")`: `{:tag :ret, :val "#object[java.io.File 0x1b2c3d4e \"/nonexistent/none.png\"]", :ns "user", :ms 0, :form "(java.io.File. \"none.png\")"}`,
+		`(java.io.File. "plot.txt")`: fmt.Sprintf(`{:tag :ret, :val "#object[java.io.File 0x1b2c3d4e \"%s.txt\"]", :ns "user", :ms 0, :form "(java.io.File. \"plot.txt\")"}`, path),
+	})
+	if err != nil {
+		t.Fatalf("failed to start fake PREPL server: %s", err)
+	}
+	defer server.Close()
+
+	client := repl.NewLazyConnectOnlyClient(server.Host(), server.Port())
+	client.SetInitForms(nil)
+	defer client.Shutdown()
+
+	tests := []struct {
+		code     string
+		expected string
+		ok       bool
+	}{
+		{code: `(java.io.File. "plot.png")`, expected: path, ok: true},
+		{code: `(java.io.File. "none.png")`, ok: false},
+		{code: `(java.io.File. "plot.txt")`, ok: false},
+	}
+
+	for _, test := range tests {
+		responses, err := client.Eval(test.code)
+		if err != nil {
+			t.Fatalf("failed to evaluate %s: %s", test.code, err)
+		}
+
+		if file, ok := imageFile(responses); ok != test.ok || file != test.expected {
+			t.Errorf("imageFile(%s) = (%s, %t), expected (%s, %t), responses: %+v", test.code, file, ok, test.expected, test.ok, responses)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package bot
+
+// feeding inputs of users to evaluations which read from `*in*` (eg. `read-line`)
+//
+// (only line-based inputs are supported: the first line of each message is written as an input)
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+const (
+	inputPromptDelayMilliseconds = 1000 // ask for an input if the evaluation is not finished in this time
+)
+
+// regular expression for codes which may read from `*in*`
+var reReadsInput = regexp.MustCompile(`\*in\*|\(\s*(?:clojure\.core/)?(?:read-line|read)[\s)]`)
+
+// watch the evaluation of given code, and ask the user for an input if it seems to be waiting for one
+//
+// (returned token should be passed to the evaluation, and `finished` should be called when the evaluation is finished)
+func (b *Bot) watchForInput(message *telegram.Message, code string) (token *repl.InputToken, finished func()) {
+	if !reReadsInput.MatchString(code) {
+		return nil, func() {}
+	}
+
+	session := b.sessions.get(message.Chat.ID)
+	token = repl.NewInputToken()
+
+	var lock sync.Mutex
+	done := false
+	stopped := make(chan struct{})
+	go func() {
+		// start waiting after the evaluation is written to REPL (not while it is queued behind others)
+		select {
+		case <-token.Written():
+		case <-stopped:
+			return
+		}
+
+		select {
+		case <-time.After(inputPromptDelayMilliseconds * time.Millisecond):
+		case <-stopped:
+			return
+		}
+
+		lock.Lock()
+		waiting := !done
+		if waiting {
+			session.setWaitingInput(token)
+		}
+		lock.Unlock()
+
+		if waiting {
+			b.sendMessage(message, messageWaitingInput)
+		}
+	}()
+
+	return token, func() {
+		lock.Lock()
+		if !done {
+			done = true
+			close(stopped)
+		}
+		session.clearWaitingInput(token)
+		lock.Unlock()
+	}
+}
+
+// write the text of given message to `*in*` of the evaluation which is waiting for an input
+func (b *Bot) feedInput(message *telegram.Message) string {
+	session := b.sessions.get(message.Chat.ID)
+
+	token := session.waitingInputToken()
+	if err := b.client.WriteInput(token, *message.Text); err != nil {
+		session.clearWaitingInput(token)
+
+		return fmt.Sprintf("error: %s", err)
+	}
+
+	return "" // (result will be sent as a reply to the evaluated message)
+}
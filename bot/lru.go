@@ -0,0 +1,58 @@
+package bot
+
+// least-recently-used cache of message ids
+
+import (
+	"container/list"
+)
+
+// lruEntry is an entry of lruCache
+type lruEntry struct {
+	key   int64
+	value int64
+}
+
+// lruCache maps message ids to message ids, evicting the least recently used ones over its size
+//
+// (not safe for concurrent use: should be guarded by its owner's lock)
+type lruCache struct {
+	size    int
+	entries map[int64]*list.Element
+	order   *list.List // front: most recently used
+}
+
+// newLRUCache returns a new LRU cache of given size
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		entries: map[int64]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// get returns the value of given key, and marks it as the most recently used one
+func (c *lruCache) get(key int64) (value int64, exists bool) {
+	var elem *list.Element
+	if elem, exists = c.entries[key]; exists {
+		c.order.MoveToFront(elem)
+		value = elem.Value.(lruEntry).value
+	}
+
+	return value, exists
+}
+
+// set sets the value of given key as the most recently used one, and evicts the least recently used ones over the size
+func (c *lruCache) set(key, value int64) {
+	if elem, exists := c.entries[key]; exists {
+		elem.Value = lruEntry{key: key, value: value}
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(lruEntry{key: key, value: value})
+	}
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(lruEntry).key)
+	}
+}
@@ -0,0 +1,47 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	cache := newLRUCache(3)
+	cache.set(1, 10)
+	cache.set(2, 20)
+	cache.set(3, 30)
+
+	// the oldest one is evicted at capacity
+	cache.set(4, 40)
+	if _, exists := cache.get(1); exists {
+		t.Errorf("expected the oldest entry to be evicted")
+	}
+	for _, key := range []int64{2, 3, 4} {
+		if value, exists := cache.get(key); !exists || value != key*10 {
+			t.Errorf("get(%d) = (%d, %t), expected (%d, true)", key, value, exists, key*10)
+		}
+	}
+
+	// a get refreshes the recency (order is now: 2, 3, 4 => 3, 4, 2)
+	cache.get(2)
+	cache.set(5, 50)
+	if _, exists := cache.get(3); exists {
+		t.Errorf("expected the least recently used entry (3) to be evicted")
+	}
+	if _, exists := cache.get(2); !exists {
+		t.Errorf("expected the recently read entry (2) to be kept")
+	}
+
+	// a set of an existing key refreshes the recency, and updates its value (order: 4, 5, 2 => 5, 2, 4)
+	cache.set(4, 41)
+	cache.set(6, 60)
+	if _, exists := cache.get(5); exists {
+		t.Errorf("expected the least recently used entry (5) to be evicted")
+	}
+	if value, exists := cache.get(4); !exists || value != 41 {
+		t.Errorf("get(4) = (%d, %t), expected (41, true)", value, exists)
+	}
+
+	if len(cache.entries) != 3 || cache.order.Len() != 3 {
+		t.Errorf("expected 3 entries, got %d (order: %d)", len(cache.entries), cache.order.Len())
+	}
+}
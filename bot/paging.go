@@ -0,0 +1,97 @@
+package bot
+
+// pagination of long lists (with inline buttons for browsing them)
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+// list public definitions of the current namespace, with buttons for browsing pages if there are too many of them
+//
+// (the full list is saved like full results of previews, so it expires in the same way)
+func (b *Bot) listPublics(message *telegram.Message) (string, *telegram.InlineKeyboardMarkup) {
+	received, err := b.eval(message.Chat.ID, repl.CommandPublics)
+	b.auditLogger.log(message, repl.CommandPublics, err != nil || b.failed(received))
+	if err != nil {
+		return messageFailedToListPublics, nil
+	} else if repl.HasException(received) {
+		return b.respToString(received), nil
+	}
+
+	names := strings.Fields(printed(received))
+	if len(names) <= 0 {
+		return messageNoPublics, nil
+	} else if len(names) <= b.conf.PublicsPageSize {
+		return fmt.Sprintf(messagePublicsFormat, len(names), strings.Join(names, ", ")), nil
+	}
+
+	b.sessions.get(message.Chat.ID).setFullResult(message.MessageID, styledText{text: strings.Join(names, "\n")})
+
+	return b.publicsPage(names, 0), pageButtons(message.MessageID, 0, b.numPages(len(names)))
+}
+
+// number of pages for given number of items
+func (b *Bot) numPages(numItems int) int {
+	return (numItems + b.conf.PublicsPageSize - 1) / b.conf.PublicsPageSize
+}
+
+// text of the page (0-based) of given public definitions
+func (b *Bot) publicsPage(names []string, page int) string {
+	from := page * b.conf.PublicsPageSize
+	to := min(from+b.conf.PublicsPageSize, len(names))
+
+	return fmt.Sprintf(messagePublicsPageFormat, len(names), page+1, b.numPages(len(names)), strings.Join(names[from:to], ", "))
+}
+
+// inline keyboard with 'prev' and 'next' buttons for the page (0-based) of the list saved with given message id
+func pageButtons(messageID int64, page, pages int) *telegram.InlineKeyboardMarkup {
+	id := strconv.FormatInt(messageID, 10)
+
+	buttons := []telegram.InlineKeyboardButton{}
+	if page > 0 {
+		buttons = append(buttons, telegram.NewInlineKeyboardButton(buttonPrevPage).
+			SetCallbackData(callbackPage+callbackDataSeparator+id+callbackDataSeparator+strconv.Itoa(page-1)))
+	}
+	if page < pages-1 {
+		buttons = append(buttons, telegram.NewInlineKeyboardButton(buttonNextPage).
+			SetCallbackData(callbackPage+callbackDataSeparator+id+callbackDataSeparator+strconv.Itoa(page+1)))
+	}
+
+	markup := telegram.NewInlineKeyboardMarkup([][]telegram.InlineKeyboardButton{buttons})
+
+	return &markup
+}
+
+// replace the message of a paged list with another page of it
+//
+// (`arg` is the id of the message which requested the list, and the page number, eg. `1234:2`)
+func (b *Bot) turnPage(message *telegram.Message, arg string) (answer string) {
+	idStr, pageStr, _ := strings.Cut(arg, callbackDataSeparator)
+	messageID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return messageInvalidCallback
+	}
+	page, err := strconv.Atoi(pageStr)
+	if err != nil {
+		return messageInvalidCallback
+	}
+
+	list, exists := b.sessions.get(message.Chat.ID).fullResultOf(messageID)
+	if !exists {
+		return messageFullResultExpired
+	}
+
+	names := strings.Split(list.text, "\n")
+	if page < 0 || page >= b.numPages(len(names)) {
+		return messageInvalidCallback
+	}
+
+	b.editMessageWithMarkup(message, message.MessageID, b.publicsPage(names, page), pageButtons(messageID, page, b.numPages(len(names))), nil)
+
+	return fmt.Sprintf(messagePageFormat, page+1)
+}
@@ -0,0 +1,67 @@
+package bot
+
+// previews of large results (with inline buttons for showing the full results)
+
+import (
+	"fmt"
+	"strconv"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+// truncate given result to a preview of `PreviewChars` runes, and save the full one for showing it later
+//
+// (returns given result as it is if it is short enough)
+func (b *Bot) previewResult(message *telegram.Message, text string, entities []telegram.MessageEntity) (string, []telegram.MessageEntity, bool) {
+	text, entities = trimStyled(text, entities)
+
+	runes := []rune(text)
+	if len(runes) <= b.conf.PreviewChars {
+		return text, entities, false
+	}
+
+	b.sessions.get(message.Chat.ID).setFullResult(message.MessageID, styledText{text: text, entities: entities})
+
+	preview := string(runes[:b.conf.PreviewChars])
+	entities = clipEntities(entities, 0, utf16Len(preview))
+
+	return preview + fmt.Sprintf(messagePreviewTruncatedFormat, len(runes)-b.conf.PreviewChars), entities, true
+}
+
+// add a row with a 'show more' button to given inline keyboard (creates a new one if it is nil)
+func withMoreButton(markup *telegram.InlineKeyboardMarkup, messageID int64) *telegram.InlineKeyboardMarkup {
+	button := telegram.NewInlineKeyboardButton(buttonShowMore).
+		SetCallbackData(callbackShowMore + callbackDataSeparator + strconv.FormatInt(messageID, 10))
+
+	if markup == nil {
+		more := telegram.NewInlineKeyboardMarkup([][]telegram.InlineKeyboardButton{{button}})
+		return &more
+	}
+
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []telegram.InlineKeyboardButton{button})
+
+	return markup
+}
+
+// send the full result of a truncated preview (as a file, if it is too long for messages)
+func (b *Bot) showMore(message *telegram.Message, arg string) (answer string) {
+	messageID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return messageInvalidCallback
+	}
+
+	result, exists := b.sessions.get(message.Chat.ID).fullResultOf(messageID)
+	if !exists {
+		return messageFullResultExpired
+	}
+
+	if len([]rune(result.text)) > maxMessageLength*b.conf.MaxMessagesPerResult {
+		if _, sent := b.sendDocument(message, resultFilename, []byte(result.text)); sent {
+			return messageFullResultSent
+		}
+	}
+
+	b.sendMessageWithMarkup(message, result.text, b.changedReplyMarkup(message.Chat), result.entities)
+
+	return messageFullResultSent
+}
@@ -0,0 +1,90 @@
+package bot
+
+// reporting exceptions to the admin chat (with inline 'report' buttons)
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+// save the stack trace of the exception in given responses (if any) with the history item of given message,
+// for reporting it later (only when `admin_chat_id` is set)
+func (b *Bot) saveException(message *telegram.Message, responses []repl.Response) {
+	if b.conf.AdminChatID == 0 || !repl.HasException(responses) {
+		return
+	}
+
+	// (fetched right away, as `*e` is shared with other evaluations)
+	trace := b.respToString(responses)
+	if received, err := b.eval(message.Chat.ID, repl.CommandPst); err == nil && !repl.HasException(received) {
+		if printed := printed(received); printed != "" {
+			trace = printed
+		}
+	}
+
+	b.sessions.get(message.Chat.ID).setHistoryException(message.MessageID, trace)
+}
+
+// check if the history item of given message has an exception to report
+func (b *Bot) hasException(message *telegram.Message) bool {
+	if b.conf.AdminChatID == 0 {
+		return false
+	}
+
+	item, exists := b.sessions.get(message.Chat.ID).historyOf(message.MessageID)
+
+	return exists && item.exception != ""
+}
+
+// add a row with a 'report' button to given inline keyboard (creates a new one if it is nil)
+func withReportButton(markup *telegram.InlineKeyboardMarkup, messageID int64) *telegram.InlineKeyboardMarkup {
+	button := telegram.NewInlineKeyboardButton(buttonReport).
+		SetCallbackData(callbackReport + callbackDataSeparator + strconv.FormatInt(messageID, 10))
+
+	if markup == nil {
+		report := telegram.NewInlineKeyboardMarkup([][]telegram.InlineKeyboardButton{{button}})
+		return &report
+	}
+
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []telegram.InlineKeyboardButton{button})
+
+	return markup
+}
+
+// send the form and stack trace of an exception to the admin chat
+func (b *Bot) reportException(message *telegram.Message, arg string) (answer string) {
+	if b.conf.AdminChatID == 0 {
+		return messageInvalidCallback
+	}
+
+	messageID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return messageInvalidCallback
+	}
+
+	item, exists := b.sessions.get(message.Chat.ID).historyOf(messageID)
+	if !exists || item.exception == "" {
+		return messageNoSuchHistory
+	}
+
+	report := fmt.Sprintf(messageReportFormat, message.Chat.ID, strings.TrimSpace(item.code), item.exception)
+	if runes := []rune(report); len(runes) > maxMessageLength {
+		report = string(runes[:maxMessageLength]) + messageTruncated
+	}
+
+	options := telegram.OptionsSendMessage{}
+	if b.formatter.parseMode != nil {
+		options = options.SetParseMode(*b.formatter.parseMode)
+	}
+	if res := sendWithRetry("report", func() telegram.APIResponse[telegram.Message] {
+		return b.api.SendMessage(b.conf.AdminChatID, b.formatter.format(report), options)
+	}); !res.Ok {
+		return messageReportFailed
+	}
+
+	return messageReported
+}
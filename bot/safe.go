@@ -0,0 +1,103 @@
+package bot
+
+// safe mode: a lockdown for public deployments
+//
+// When `safe_mode` is enabled:
+//
+//   - uploaded files and URLs of files are not loaded,
+//   - libraries cannot be added with /deps,
+//   - returned image files are not sent as photos, and
+//   - forms which mention functions, namespaces, or classes for accessing the filesystem or shell
+//     (eg. `slurp`, `spit`, `clojure.java.io`, `clojure.java.shell`, `java.lang.*`, `java.io.*`, `java.nio.*`, `Runtime`, `ProcessBuilder`),
+//     or for evaluating code built at runtime (eg. `eval`, `read-string`, `load-string`, `resolve`), are rejected before evaluation.
+//     (namespace-qualified symbols, eg. `clojure.core/slurp`, are checked with their names)
+//
+// (forms are checked textually, so it is a best-effort filter, not a sandbox)
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regular expression for tokens of symbols (and any other words) in forms
+var reToken = regexp.MustCompile("[^\\s,()\\[\\]{}\"';@^~`#\\\\]+")
+
+// names of functions which touch the filesystem, or evaluate code built at runtime (with or without namespaces)
+var unsafeNames = map[string]bool{
+	"slurp":             true,
+	"spit":              true,
+	"load":              true,
+	"load-file":         true,
+	"load-reader":       true,
+	"load-string":       true,
+	"eval":              true,
+	"read-string":       true,
+	"resolve":           true,
+	"ns-resolve":        true,
+	"requiring-resolve": true,
+	"find-var":          true,
+}
+
+// namespaces, packages, and classes which touch the filesystem or shell
+// (also matches the ones prefixed with them, eg. `java.io.File`)
+var unsafeNamespaces = []string{
+	"clojure.java.io",
+	"clojure.java.shell",
+	"java.lang",
+	"java.io",
+	"java.nio",
+	"Runtime",
+	"ProcessBuilder",
+}
+
+// qualified symbols which touch the shell or environment
+var unsafeQualifiedSymbols = map[string]bool{
+	"System/exit":   true,
+	"System/getenv": true,
+	"Class/forName": true,
+}
+
+// check if given code can be evaluated in safe mode (always true if safe mode is disabled)
+func (b *Bot) checkSafe(code string) error {
+	if !b.conf.SafeMode {
+		return nil
+	}
+
+	if symbol, unsafe := unsafeSymbol(code); unsafe {
+		return fmt.Errorf("rejected in safe mode (`%s` touches the filesystem or shell, or evaluates code)", symbol)
+	}
+
+	return nil
+}
+
+// find the first symbol in given code which is not allowed in safe mode
+func unsafeSymbol(code string) (symbol string, unsafe bool) {
+	for _, token := range reToken.FindAllString(code, -1) {
+		if strings.HasPrefix(token, ":") { // (keywords)
+			continue
+		}
+
+		// (eg. `(.exec ...)`, `(ProcessBuilder. ...)`)
+		sym := strings.TrimSuffix(strings.TrimPrefix(token, "."), ".")
+
+		ns, name, qualified := strings.Cut(sym, "/")
+		if !qualified {
+			ns, name = "", sym
+		}
+
+		if unsafeNames[name] || unsafeQualifiedSymbols[sym] {
+			return token, true
+		}
+
+		for _, prefix := range unsafeNamespaces {
+			for _, s := range []string{ns, sym} {
+				if s == prefix || strings.HasPrefix(s, prefix+".") || strings.HasPrefix(s, prefix+"$") {
+					return token, true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
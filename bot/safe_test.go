@@ -0,0 +1,48 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestUnsafeSymbol(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string // (empty if safe)
+	}{
+		// safe forms
+		{code: `(+ 1 2)`},
+		{code: `(map inc [1 2 3])`},
+		{code: `(Math/abs -1)`},
+		{code: `(require '[clojure.string :as str])`},
+		{code: `{:load true, :eval false}`},
+		{code: `(defn evaluate [x] x)`},
+
+		// unsafe functions
+		{code: `(slurp "/etc/passwd")`, expected: `slurp`},
+		{code: `(clojure.core/slurp "/etc/passwd")`, expected: `clojure.core/slurp`},
+		{code: `(#'clojure.core/spit "/tmp/x" "y")`, expected: `clojure.core/spit`},
+		{code: `(eval (read-string (str "(sl" "urp \"/etc/passwd\")")))`, expected: `eval`},
+		{code: `(read-string "#=(+ 1 2)")`, expected: `read-string`},
+		{code: `(load-string "(+ 1 2)")`, expected: `load-string`},
+		{code: `((resolve (symbol "slurp")) "/etc/passwd")`, expected: `resolve`},
+
+		// unsafe namespaces and classes
+		{code: `(clojure.java.shell/sh "id")`, expected: `clojure.java.shell/sh`},
+		{code: `(require '[clojure.java.io :as io])`, expected: `clojure.java.io`},
+		{code: `(.exec (java.lang.Runtime/getRuntime) "id")`, expected: `java.lang.Runtime/getRuntime`},
+		{code: `(.exec (Runtime/getRuntime) "id")`, expected: `Runtime/getRuntime`},
+		{code: `(.start (java.lang.ProcessBuilder. ["id"]))`, expected: `java.lang.ProcessBuilder.`},
+		{code: `(.start (ProcessBuilder. ["id"]))`, expected: `ProcessBuilder.`},
+		{code: `(import '[java.nio.file Files])`, expected: `java.nio.file`},
+		{code: `(java.io.File. "/tmp")`, expected: `java.io.File.`},
+		{code: `(System/exit 0)`, expected: `System/exit`},
+		{code: `(Class/forName "java.lang.Runtime")`, expected: `Class/forName`},
+	}
+
+	for _, test := range tests {
+		symbol, unsafe := unsafeSymbol(test.code)
+		if unsafe != (test.expected != "") || symbol != test.expected {
+			t.Errorf("unsafeSymbol(%s) = (%s, %t), expected %s", test.code, symbol, unsafe, test.expected)
+		}
+	}
+}
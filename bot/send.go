@@ -0,0 +1,52 @@
+package bot
+
+// sending to Telegram (with retries on rate limits)
+
+import (
+	"log"
+	"time"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	maxSendRetries = 3
+	maxRetryAfter  = 30 * time.Second // (not retried if told to wait longer than this)
+)
+
+// call given send function, and retry it after the requested time when rate-limited (HTTP 429)
+//
+// (failures are logged with `what`, eg. "message" or "document")
+func sendWithRetry[T any](what string, send func() telegram.APIResponse[T]) telegram.APIResponse[T] {
+	res := send()
+	for retries := 0; !res.Ok && retries < maxSendRetries; retries++ {
+		if res.Parameters == nil || res.Parameters.RetryAfter == nil {
+			break
+		}
+
+		wait := time.Duration(*res.Parameters.RetryAfter) * time.Second
+		if wait > maxRetryAfter {
+			break
+		}
+
+		log.Printf("rate limited while sending %s, retrying in %s", what, wait)
+		time.Sleep(wait)
+
+		res = send()
+	}
+
+	if !res.Ok {
+		log.Printf("failed to send %s: %s", what, describe(res.Description))
+	}
+
+	return res
+}
+
+// description of a failed API response (which may be missing)
+func describe(description *string) string {
+	if description == nil {
+		return "unknown error"
+	}
+
+	return *description
+}
@@ -0,0 +1,581 @@
+package bot
+
+// per-chat session states
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+const (
+	maxHistoryItems = 20
+	maxPendingURLs  = 10
+	maxFullResults  = 10
+	fullResultTTL   = 1 * time.Hour
+
+	sandboxNamespacePrefix = "sandbox.s"
+)
+
+// historyItem is an evaluated code and its result
+type historyItem struct {
+	time      time.Time
+	messageID int64 // id of the received message
+	code      string
+	result    string
+	exception string // stack trace of the exception (for reporting it)
+}
+
+// session is a state of each chat
+type session struct {
+	showKeyboard     bool
+	sentKeyboard     string          // serialized reply markup which was sent last (empty if not sent yet)
+	hiddenCategories map[string]bool // names of hidden keyboard categories
+	history          []historyItem
+	namespace        string // current namespace (from the last response)
+	sandbox          string // name of sandbox namespace (empty if not created yet)
+
+	replies *lruCache // received message id => sent reply id
+
+	pendingURLs map[int64]string // received message id => url waiting for confirmation
+
+	fullResults map[int64]fullResult // received message id => full result of a truncated preview
+
+	printLength string // overridden value of `*print-length*` (empty if not overridden)
+
+	inFlight   map[int]context.CancelFunc // cancel functions of evaluations in flight (for /stop)
+	lastEvalID int
+
+	waitingInput *repl.InputToken // input token of the evaluation which is waiting for an input (eg. `read-line`), nil if none
+
+	buffering bool     // whether received messages are buffered (for evaluating them at once with /run) or not
+	buffer    []string // buffered messages
+
+	lastActive time.Time
+
+	sync.Mutex
+}
+
+// fullResult is a full result of a truncated preview, with the time it was stored
+type fullResult struct {
+	styledText
+	storedAt time.Time
+}
+
+// sessionManager manages sessions of chats
+type sessionManager struct {
+	sessions map[int64]*session
+
+	showKeyboard   bool // default value for new sessions
+	replyCacheSize int  // size of reply caches for new sessions
+
+	sync.Mutex
+}
+
+// newSessionManager returns a new session manager
+func newSessionManager(showKeyboard bool, replyCacheSize int) *sessionManager {
+	return &sessionManager{
+		sessions:       map[int64]*session{},
+		showKeyboard:   showKeyboard,
+		replyCacheSize: replyCacheSize,
+	}
+}
+
+// get returns the session of given chat id (creates a new one if there is none)
+func (m *sessionManager) get(chatID int64) *session {
+	m.Lock()
+
+	s, exists := m.sessions[chatID]
+	if !exists {
+		s = &session{
+			showKeyboard:     m.showKeyboard,
+			hiddenCategories: map[string]bool{},
+			replies:          newLRUCache(m.replyCacheSize),
+			pendingURLs:      map[int64]string{},
+			fullResults:      map[int64]fullResult{},
+			inFlight:         map[int]context.CancelFunc{},
+		}
+		m.sessions[chatID] = s
+	}
+
+	s.Lock()
+	s.lastActive = time.Now()
+	s.Unlock()
+
+	m.Unlock()
+
+	return s
+}
+
+// remove removes the session of given chat id, and returns it
+func (m *sessionManager) remove(chatID int64) (s *session, exists bool) {
+	m.Lock()
+
+	if s, exists = m.sessions[chatID]; exists {
+		delete(m.sessions, chatID)
+	}
+
+	m.Unlock()
+
+	return s, exists
+}
+
+// sessionInfo is a summary of a session
+type sessionInfo struct {
+	chatID    int64
+	idle      time.Duration
+	namespace string // current namespace (empty if not known yet)
+	sandbox   string // created sandbox namespace (empty if not created yet)
+}
+
+// list returns summaries of all sessions, in the order of chat ids
+func (m *sessionManager) list() []sessionInfo {
+	m.Lock()
+
+	infos := []sessionInfo{}
+	for chatID, s := range m.sessions {
+		s.Lock()
+		infos = append(infos, sessionInfo{
+			chatID:    chatID,
+			idle:      time.Since(s.lastActive),
+			namespace: s.namespace,
+			sandbox:   s.sandbox,
+		})
+		s.Unlock()
+	}
+
+	m.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].chatID < infos[j].chatID })
+
+	return infos
+}
+
+// expire removes sessions which have been idle longer than given timeout, and returns them
+func (m *sessionManager) expire(timeout time.Duration) (expired []*session) {
+	m.Lock()
+
+	for chatID, s := range m.sessions {
+		s.Lock()
+		idle := time.Since(s.lastActive)
+		s.Unlock()
+
+		if idle > timeout {
+			expired = append(expired, s)
+			delete(m.sessions, chatID)
+		}
+	}
+
+	m.Unlock()
+
+	return expired
+}
+
+// isKeyboardShown returns whether the custom keyboard should be shown or not
+func (s *session) isKeyboardShown() bool {
+	s.Lock()
+	shown := s.showKeyboard
+	s.Unlock()
+
+	return shown
+}
+
+// setKeyboardShown sets whether the custom keyboard should be shown or not
+func (s *session) setKeyboardShown(shown bool) {
+	s.Lock()
+	s.showKeyboard = shown
+	s.Unlock()
+}
+
+// lastSentKeyboard returns the serialized reply markup which was sent last (empty if not sent yet)
+func (s *session) lastSentKeyboard() string {
+	s.Lock()
+	serialized := s.sentKeyboard
+	s.Unlock()
+
+	return serialized
+}
+
+// setSentKeyboard saves given serialized reply markup as the last sent one (empty for sending it again)
+func (s *session) setSentKeyboard(serialized string) {
+	s.Lock()
+	s.sentKeyboard = serialized
+	s.Unlock()
+}
+
+// isCategoryHidden returns whether the keyboard category with given name is hidden or not
+func (s *session) isCategoryHidden(name string) bool {
+	s.Lock()
+	hidden := s.hiddenCategories[name]
+	s.Unlock()
+
+	return hidden
+}
+
+// toggleCategory toggles the visibility of the keyboard category with given name, and returns whether it is hidden now
+func (s *session) toggleCategory(name string) (hidden bool) {
+	s.Lock()
+
+	hidden = !s.hiddenCategories[name]
+	if hidden {
+		s.hiddenCategories[name] = true
+	} else {
+		delete(s.hiddenCategories, name)
+	}
+
+	s.Unlock()
+
+	return hidden
+}
+
+// appendHistory appends given code (of given message id) and its result to the history (bounded by `maxHistoryItems`)
+func (s *session) appendHistory(messageID int64, code, result string) {
+	s.Lock()
+
+	s.history = append(s.history, historyItem{
+		time:      time.Now(),
+		messageID: messageID,
+		code:      code,
+		result:    result,
+	})
+	if len(s.history) > maxHistoryItems {
+		s.history = s.history[len(s.history)-maxHistoryItems:]
+	}
+
+	s.Unlock()
+}
+
+// setHistoryException sets the exception of the most recent history item of given message id
+func (s *session) setHistoryException(messageID int64, exception string) {
+	s.Lock()
+
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].messageID == messageID {
+			s.history[i].exception = exception
+			break
+		}
+	}
+
+	s.Unlock()
+}
+
+// allHistory returns a copy of all history items (oldest first)
+func (s *session) allHistory() []historyItem {
+	s.Lock()
+	items := append([]historyItem{}, s.history...)
+	s.Unlock()
+
+	return items
+}
+
+// nthLastHistory returns the n-th last history item (1 for the most recent one)
+func (s *session) nthLastHistory(n int) (item historyItem, exists bool) {
+	s.Lock()
+
+	if n > 0 && n <= len(s.history) {
+		item, exists = s.history[len(s.history)-n], true
+	}
+
+	s.Unlock()
+
+	return item, exists
+}
+
+// historyOf returns the most recent history item of given message id
+func (s *session) historyOf(messageID int64) (item historyItem, exists bool) {
+	s.Lock()
+
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].messageID == messageID {
+			item, exists = s.history[i], true
+			break
+		}
+	}
+
+	s.Unlock()
+
+	return item, exists
+}
+
+// replyTo returns the id of the reply which was sent for given message id
+func (s *session) replyTo(messageID int64) (replyID int64, exists bool) {
+	s.Lock()
+	replyID, exists = s.replies.get(messageID)
+	s.Unlock()
+
+	return replyID, exists
+}
+
+// setReplyTo saves the id of the reply which was sent for given message id
+// (least recently used ones are evicted over the size of the cache)
+func (s *session) setReplyTo(messageID, replyID int64) {
+	s.Lock()
+	s.replies.set(messageID, replyID)
+	s.Unlock()
+}
+
+// updateNamespace updates the current namespace with the last one in given responses
+func (s *session) updateNamespace(responses []repl.Response) {
+	s.Lock()
+
+	for _, r := range responses {
+		if r.Namespace != "" {
+			s.namespace = r.Namespace
+		}
+	}
+
+	s.Unlock()
+}
+
+// currentNamespace returns the current namespace (empty if unknown yet)
+func (s *session) currentNamespace() string {
+	s.Lock()
+	ns := s.namespace
+	s.Unlock()
+
+	return ns
+}
+
+// setPendingURL saves given url which is waiting for confirmation (bounded by `maxPendingURLs`)
+func (s *session) setPendingURL(messageID int64, url string) {
+	s.Lock()
+
+	s.pendingURLs[messageID] = url
+
+	// evict the oldest ones
+	for len(s.pendingURLs) > maxPendingURLs {
+		oldest := messageID
+		for id := range s.pendingURLs {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		delete(s.pendingURLs, oldest)
+	}
+
+	s.Unlock()
+}
+
+// popPendingURL returns and removes the url which was waiting for confirmation
+func (s *session) popPendingURL(messageID int64) (url string, exists bool) {
+	s.Lock()
+
+	if url, exists = s.pendingURLs[messageID]; exists {
+		delete(s.pendingURLs, messageID)
+	}
+
+	s.Unlock()
+
+	return url, exists
+}
+
+// setFullResult saves the full result of a truncated preview (bounded by `maxFullResults`, expires after `fullResultTTL`)
+func (s *session) setFullResult(messageID int64, result styledText) {
+	s.Lock()
+
+	s.fullResults[messageID] = fullResult{styledText: result, storedAt: time.Now()}
+
+	// evict expired ones, and then the oldest ones
+	for id, r := range s.fullResults {
+		if time.Since(r.storedAt) > fullResultTTL {
+			delete(s.fullResults, id)
+		}
+	}
+	for len(s.fullResults) > maxFullResults {
+		oldest := messageID
+		for id := range s.fullResults {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		delete(s.fullResults, oldest)
+	}
+
+	s.Unlock()
+}
+
+// fullResultOf returns the (not expired) full result of a truncated preview
+func (s *session) fullResultOf(messageID int64) (result styledText, exists bool) {
+	s.Lock()
+
+	var r fullResult
+	if r, exists = s.fullResults[messageID]; exists {
+		if time.Since(r.storedAt) > fullResultTTL {
+			delete(s.fullResults, messageID)
+			exists = false
+		} else {
+			result = r.styledText
+		}
+	}
+
+	s.Unlock()
+
+	return result, exists
+}
+
+// startEval returns a cancellable context for an evaluation, and a function to be called when it is finished
+func (s *session) startEval() (ctx context.Context, finish func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.Lock()
+	s.lastEvalID++
+	id := s.lastEvalID
+	s.inFlight[id] = cancel
+	s.Unlock()
+
+	return ctx, func() {
+		s.Lock()
+		delete(s.inFlight, id)
+		s.Unlock()
+
+		cancel()
+	}
+}
+
+// stopEvals cancels all evaluations in flight, and returns the number of them
+func (s *session) stopEvals() int {
+	s.Lock()
+
+	stopped := len(s.inFlight)
+	for id, cancel := range s.inFlight {
+		cancel()
+		delete(s.inFlight, id)
+	}
+
+	s.Unlock()
+
+	return stopped
+}
+
+// isWaitingInput returns whether an evaluation is waiting for an input or not
+func (s *session) isWaitingInput() bool {
+	return s.waitingInputToken() != nil
+}
+
+// waitingInputToken returns the input token of the evaluation which is waiting for an input (nil if none)
+func (s *session) waitingInputToken() *repl.InputToken {
+	s.Lock()
+	token := s.waitingInput
+	s.Unlock()
+
+	return token
+}
+
+// setWaitingInput sets the input token of the evaluation which is waiting for an input
+func (s *session) setWaitingInput(token *repl.InputToken) {
+	s.Lock()
+	s.waitingInput = token
+	s.Unlock()
+}
+
+// clearWaitingInput clears the waiting input, if it is of given token
+func (s *session) clearWaitingInput(token *repl.InputToken) {
+	s.Lock()
+	if s.waitingInput == token {
+		s.waitingInput = nil
+	}
+	s.Unlock()
+}
+
+// printLengthOverride returns the overridden value of `*print-length*` (empty if not overridden)
+func (s *session) printLengthOverride() string {
+	s.Lock()
+	length := s.printLength
+	s.Unlock()
+
+	return length
+}
+
+// setPrintLengthOverride overrides the value of `*print-length*`
+func (s *session) setPrintLengthOverride(length string) {
+	s.Lock()
+	s.printLength = length
+	s.Unlock()
+}
+
+// isBuffering returns whether received messages are being buffered or not
+func (s *session) isBuffering() bool {
+	s.Lock()
+	buffering := s.buffering
+	s.Unlock()
+
+	return buffering
+}
+
+// toggleBuffering toggles buffer mode (discarding buffered messages), and returns whether it is on now
+func (s *session) toggleBuffering() (buffering bool) {
+	s.Lock()
+
+	s.buffering = !s.buffering
+	s.buffer = nil
+	buffering = s.buffering
+
+	s.Unlock()
+
+	return buffering
+}
+
+// appendBuffer appends given text to the buffer, and returns the accumulated length (in characters)
+func (s *session) appendBuffer(text string) (length int) {
+	s.Lock()
+
+	s.buffer = append(s.buffer, text)
+	length = utf8.RuneCountInString(strings.Join(s.buffer, "\n"))
+
+	s.Unlock()
+
+	return length
+}
+
+// flushBuffer returns buffered messages joined with newlines, and turns off buffer mode
+func (s *session) flushBuffer() string {
+	s.Lock()
+
+	code := strings.Join(s.buffer, "\n")
+	s.buffering = false
+	s.buffer = nil
+
+	s.Unlock()
+
+	return code
+}
+
+// sandboxNamespace returns the name of this session's sandbox namespace (generates a new one if there is none)
+func (s *session) sandboxNamespace() string {
+	s.Lock()
+
+	if s.sandbox == "" {
+		bytes := make([]byte, 8)
+		_, _ = rand.Read(bytes)
+
+		s.sandbox = sandboxNamespacePrefix + hex.EncodeToString(bytes)
+	}
+	ns := s.sandbox
+
+	s.Unlock()
+
+	return ns
+}
+
+// createdSandboxNamespace returns the name of this session's sandbox namespace (empty if not created yet)
+func (s *session) createdSandboxNamespace() string {
+	s.Lock()
+	ns := s.sandbox
+	s.Unlock()
+
+	return ns
+}
+
+// discardSandboxNamespace discards the name of this session's sandbox namespace
+func (s *session) discardSandboxNamespace() {
+	s.Lock()
+	s.sandbox = ""
+	s.Unlock()
+}
@@ -0,0 +1,141 @@
+package bot
+
+// running host commands with `clojure.java.shell/sh` (for admins only)
+
+import (
+	"fmt"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+	"olympos.io/encoding/edn"
+)
+
+const (
+	maxShellOutputLength = 3000 // in characters, for each of stdout and stderr (truncated in REPL)
+	shellTimeoutSeconds  = 30
+)
+
+// run given command line on the REPL host, and return its exit code, stdout, and stderr
+//
+// (arguments are passed to the command as they are, without any interpolation by a shell)
+func (b *Bot) runShell(message *telegram.Message, cmdline string) string {
+	args, err := splitShellArgs(cmdline)
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	} else if len(args) <= 0 {
+		return messageUsageShell
+	}
+
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, repl.QuoteString(arg))
+	}
+	code := fmt.Sprintf(repl.CommandFormatShell, strings.Join(quoted, " "), shellTimeoutSeconds*1000, maxShellOutputLength)
+
+	// (can be stopped with /stop, and waits for a free slot of evaluation like others)
+	received, err := b.eval(message.Chat.ID, code)
+	b.auditLogger.log(message, code, err != nil || b.failed(received))
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	} else if repl.HasException(received) {
+		return b.respToString(received)
+	} else if returns(received, repl.ValueTimeout) {
+		return fmt.Sprintf(messageShellTimedOutFormat, shellTimeoutSeconds)
+	}
+
+	for _, r := range received {
+		if r.Tag != "ret" {
+			continue
+		}
+
+		var result []any
+		if err := edn.Unmarshal([]byte(r.Value), &result); err == nil && len(result) == 5 {
+			exit, _ := result[0].(int64)
+			stdout, _ := result[1].(string)
+			stderr, _ := result[2].(string)
+			stdoutLength, _ := result[3].(int64)
+			stderrLength, _ := result[4].(int64)
+
+			lines := []string{fmt.Sprintf(messageShellExitFormat, exit)}
+			if out := strings.TrimSpace(stdout); out != "" {
+				lines = append(lines, fmt.Sprintf(messageShellStdoutFormat, withTruncatedMark(out, stdoutLength > maxShellOutputLength)))
+			}
+			if errOut := strings.TrimSpace(stderr); errOut != "" {
+				lines = append(lines, fmt.Sprintf(messageShellStderrFormat, withTruncatedMark(errOut, stderrLength > maxShellOutputLength)))
+			}
+
+			return strings.Join(lines, "\n\n")
+		}
+	}
+
+	return b.respToString(received)
+}
+
+// append a mark to given string, if it was truncated
+func withTruncatedMark(str string, truncated bool) string {
+	if truncated {
+		return str + messageTruncated
+	}
+
+	return str
+}
+
+// split given command line into arguments, with quotes and backslashes like a shell (but without any expansion)
+//
+// eg. `ls -al "my dir"` => ["ls", "-al", "my dir"]
+func splitShellArgs(cmdline string) (args []string, err error) {
+	var current strings.Builder
+	inArg := false
+	var quote rune // `'` or `"` while in quotes
+
+	runes := []rune(cmdline)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\') {
+				i++
+				current.WriteRune(runes[i])
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			current.WriteRune(runes[i])
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote: %c", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
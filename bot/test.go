@@ -0,0 +1,67 @@
+package bot
+
+// running tests of namespaces (with concise reports of their results)
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+)
+
+// regular expressions for the summary printed by `clojure.test/run-tests`
+var (
+	reTestingNamespace = regexp.MustCompile(`(?m)^Testing (\S+)$`)
+	reTestsRan         = regexp.MustCompile(`Ran (\d+) tests containing (\d+) assertions\.`)
+	reTestsFailed      = regexp.MustCompile(`(\d+) failures, (\d+) errors\.`)
+)
+
+// run tests of given namespace (the current one, if empty) and report a summary of their results
+//
+// (when any test has failed, its details are saved for showing them with a 'show more' button)
+func (b *Bot) runTests(message *telegram.Message, ns string) (result string, hasDetails bool) {
+	code := repl.CommandRunTests
+	if ns != "" {
+		if !repl.IsValidNamespace(ns) {
+			return fmt.Sprintf(messageInvalidNamespaceFormat, ns), false
+		}
+		code = fmt.Sprintf(repl.CommandFormatRunTests, ns)
+	}
+
+	received, err := b.eval(message.Chat.ID, code)
+	b.auditLogger.log(message, code, err != nil || b.failed(received))
+	if err != nil {
+		return fmt.Sprintf("error: %s", err), false
+	}
+	if repl.HasException(received) {
+		return b.respToString(received), false
+	}
+
+	output := printed(received)
+	if matches := reTestingNamespace.FindStringSubmatch(output); matches != nil {
+		ns = matches[1]
+	}
+
+	ran := reTestsRan.FindStringSubmatch(output)
+	failed := reTestsFailed.FindStringSubmatch(output)
+	if ran == nil || failed == nil { // not a summary of `run-tests`
+		return output, false
+	}
+	if ran[1] == "0" {
+		return fmt.Sprintf(messageNoTestsFormat, ns), false
+	}
+
+	numFailures, _ := strconv.Atoi(failed[1])
+	numErrors, _ := strconv.Atoi(failed[2])
+	result = fmt.Sprintf(messageTestsSummaryFormat, ns, ran[1], ran[2], numFailures, numErrors)
+	if numFailures+numErrors <= 0 {
+		return result + "\n" + messageTestsPassed, false
+	}
+
+	b.sessions.get(message.Chat.ID).setFullResult(message.MessageID, styledText{text: strings.TrimSpace(output)})
+
+	return result + "\n" + messageTestsFailed, true
+}
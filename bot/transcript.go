@@ -0,0 +1,97 @@
+package bot
+
+// exporting history of sessions as transcripts
+
+import (
+	"fmt"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+// formats of transcripts
+const (
+	transcriptFormatClj      = "clj"
+	transcriptFormatMarkdown = "md"
+	transcriptArgTime        = "time" // include timestamps
+
+	transcriptFilenameFormat     = "transcript-%s.%s"
+	transcriptFilenameTimeFormat = "20060102-150405"
+	transcriptTimeFormat         = "2006-01-02 15:04:05 MST"
+)
+
+// send the history of the chat as a transcript file
+//
+// `args` can have a format ("clj" or "md", default: "clj") and "time" for including timestamps (eg. `md time`)
+func (b *Bot) sendTranscript(message *telegram.Message, args string) string {
+	format, withTime := transcriptFormatClj, false
+	for _, arg := range strings.Fields(strings.ToLower(args)) {
+		switch arg {
+		case transcriptFormatClj, transcriptFormatMarkdown:
+			format = arg
+		case transcriptArgTime:
+			withTime = true
+		default:
+			return messageUsageTranscript
+		}
+	}
+
+	items := b.sessions.get(message.Chat.ID).allHistory()
+	if len(items) <= 0 {
+		return messageNoHistory
+	}
+
+	var transcript string
+	if format == transcriptFormatMarkdown {
+		transcript = markdownTranscript(items, withTime)
+	} else {
+		transcript = cljTranscript(items, withTime)
+	}
+
+	filename := fmt.Sprintf(transcriptFilenameFormat, items[0].time.Format(transcriptFilenameTimeFormat), format)
+	if _, sent := b.sendDocument(message, filename, []byte(transcript)); !sent {
+		return transcript
+	}
+
+	return ""
+}
+
+// transcript of given history items as a Clojure file (results are commented out)
+func cljTranscript(items []historyItem, withTime bool) string {
+	var sb strings.Builder
+
+	for i, item := range items {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		if withTime {
+			fmt.Fprintf(&sb, ";; %s\n", item.time.Format(transcriptTimeFormat))
+		}
+		sb.WriteString(strings.TrimSpace(item.code) + "\n")
+		for _, line := range strings.Split(strings.TrimSpace(item.result), "\n") {
+			sb.WriteString(strings.TrimRight(";; "+line, " ") + "\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// transcript of given history items as a Markdown file
+func markdownTranscript(items []historyItem, withTime bool) string {
+	var sb strings.Builder
+
+	for i, item := range items {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		if withTime {
+			fmt.Fprintf(&sb, "### %d (%s)\n\n", i+1, item.time.Format(transcriptTimeFormat))
+		} else {
+			fmt.Fprintf(&sb, "### %d\n\n", i+1)
+		}
+		fmt.Fprintf(&sb, "```clojure\n%s\n```\n\n", strings.TrimSpace(item.code))
+		fmt.Fprintf(&sb, "```\n%s\n```\n", strings.TrimSpace(item.result))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,105 @@
+package bot
+
+// loading remote files from URLs (after confirmation with inline buttons)
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	telegram "github.com/meinside/telegram-bot-go"
+)
+
+// extensions of files which can be loaded from URLs
+var loadableExtensions = []string{".clj", extCljc, extEdn}
+
+// check if given text is just a URL of a loadable file
+func loadableURL(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if strings.ContainsAny(text, " \t\r\n") {
+		return "", false
+	}
+
+	if u, err := url.Parse(text); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		ext := urlExt(text)
+		for _, e := range loadableExtensions {
+			if e == ext {
+				return text, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// ask the user to confirm loading given URL
+func (b *Bot) askToLoadURL(message *telegram.Message, url string) {
+	b.sessions.get(message.Chat.ID).setPendingURL(message.MessageID, url)
+
+	id := strconv.FormatInt(message.MessageID, 10)
+	b.sendMessageWithMarkup(message, fmt.Sprintf(messageConfirmLoadURLFormat, url), telegram.NewInlineKeyboardMarkup(
+		[][]telegram.InlineKeyboardButton{
+			{
+				telegram.NewInlineKeyboardButton(buttonLoad).SetCallbackData(callbackLoadURL + callbackDataSeparator + id),
+				telegram.NewInlineKeyboardButton(buttonCancel).SetCallbackData(callbackCancelLoadURL + callbackDataSeparator + id),
+			},
+		},
+	), nil)
+}
+
+// load the pending URL of given message id, and replace the confirmation message with its result
+func (b *Bot) loadPendingURL(message *telegram.Message, arg string, cancel bool) (answer string) {
+	messageID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return messageInvalidCallback
+	}
+
+	url, exists := b.sessions.get(message.Chat.ID).popPendingURL(messageID)
+	if !exists {
+		b.editMessage(message, messageURLExpired)
+		return messageURLExpired
+	}
+
+	if cancel {
+		b.editMessage(message, fmt.Sprintf(messageLoadURLCancelledFormat, url))
+		return messageLoadURLCancelled
+	}
+
+	// the message which contained the url
+	origin := message
+	if message.ReplyToMessage != nil {
+		origin = message.ReplyToMessage
+	}
+
+	// keep typing while downloading and loading the file, as it can take long
+	b.sendTyping(origin)
+	stopTyping := b.keepTyping(origin)
+	defer stopTyping()
+
+	var result string
+	if filepath, err := downloadTemporarily(url); err == nil {
+		if result, err = b.loadFile(origin, filepath, urlExt(url)); err != nil {
+			result = fmt.Sprintf("failed to load file: %s", err)
+		}
+	} else {
+		result = fmt.Sprintf("failed to download the file: %s", err)
+	}
+	if strings.TrimSpace(result) == "" {
+		result = fmt.Sprintf(messageURLLoadedFormat, url)
+	}
+
+	b.editMessage(message, result)
+
+	return fmt.Sprintf(messageURLLoadedFormat, url)
+}
+
+// (lowercased) extension of the path of given URL
+func urlExt(str string) string {
+	if u, err := url.Parse(str); err == nil {
+		return strings.ToLower(path.Ext(u.Path))
+	}
+
+	return ""
+}
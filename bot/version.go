@@ -0,0 +1,20 @@
+package bot
+
+// build information (set with `-ldflags` on build)
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// build information of the bot, set with `-ldflags` (eg. `-X github.com/meinside/telegram-clojure-repl-bot/bot.Commit=abc1234`)
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// build information as a string
+func versionString() string {
+	return fmt.Sprintf(messageVersionFormat, Version, Commit, BuildDate, runtime.Version())
+}
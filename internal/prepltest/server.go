@@ -0,0 +1,152 @@
+// Package prepltest provides an in-process fake PREPL server for testing.
+package prepltest
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pause separates parts of a scripted response which are written separately (each after `Delay`)
+const Pause = "\n<pause>\n"
+
+// Server is a fake PREPL server which replies scripted EDN responses for given inputs
+type Server struct {
+	listener net.Listener
+
+	responses map[string]string // input => EDN response(s)
+	received  []string
+
+	// Delay is a delay before writing each response
+	Delay time.Duration
+
+	// ChunkSize, if positive, splits each response into chunks of this size (written with `Delay` between them)
+	ChunkSize int
+
+	sync.Mutex
+	wg sync.WaitGroup
+}
+
+// NewServer starts a new fake PREPL server on a random local port.
+//
+// `responses` maps each input line to its raw EDN response(s), optionally separated with `Pause`.
+// Inputs without scripted responses are replied with a `:ret` of `nil`.
+func NewServer(responses map[string]string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener:  listener,
+		responses: responses,
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Host returns the host of this server
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.listener.Addr().String())
+	return host
+}
+
+// Port returns the port of this server
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Received returns inputs received so far
+func (s *Server) Received() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]string{}, s.received...)
+}
+
+// Close stops this server
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+
+	return err
+}
+
+// accept connections
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// handle a connection
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		input := strings.TrimSpace(scanner.Text())
+		if input == "" {
+			continue
+		}
+
+		s.Lock()
+		s.received = append(s.received, input)
+		response, exists := s.responses[input]
+		s.Unlock()
+
+		if !exists {
+			response = fmt.Sprintf(`{:tag :ret, :val "nil", :ns "user", :ms 0, :form %q}`, input)
+		}
+
+		for _, part := range strings.Split(response, Pause) {
+			if err := s.write(conn, part+"\n"); err != nil {
+				log.Printf("prepltest: failed to write response: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// write response (in chunks, if needed)
+func (s *Server) write(conn net.Conn, response string) error {
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(response)
+	}
+
+	for len(response) > 0 {
+		if s.Delay > 0 {
+			time.Sleep(s.Delay)
+		}
+
+		n := chunkSize
+		if n > len(response) {
+			n = len(response)
+		}
+
+		if _, err := conn.Write([]byte(response[:n])); err != nil {
+			return err
+		}
+		response = response[n:]
+	}
+
+	return nil
+}
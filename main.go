@@ -1,90 +1,58 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"path/filepath"
-	"strings"
+	"sync"
 	"syscall"
 
-	telegram "github.com/meinside/telegram-bot-go"
-	repl "github.com/meinside/telegram-clojure-repl-bot/repl"
+	"github.com/meinside/telegram-clojure-repl-bot/bot"
 )
 
 const (
-	tempDir = "/tmp"
-)
-
-const (
-	defaultMonitorInterval = 3
-
-	// telegram commands
-	commandStart   = "/start"
-	commandPublics = "/publics"
-	commandReset   = "/reset"
-
-	// telegram messages
-	messageWelcome              = "welcome!"
-	messageFailedToListPublics  = "failed to list public definitions."
-	messageFailedToReset        = "failed to reset REPL."
-	messageErrorNothingReceived = "nothing received from REPL."
-
 	usageTextFormat = `Usage:
 
 	$ %[1]s [config_filepath]
+`
+	invalidConfigFormat = `Invalid config (%s):
+
+%s
+`
+	runFailedFormat = `Failed to run bot: %s
+`
+	invalidBotConfigFormat = `Invalid config of bots[%[2]d] (%[1]s):
+
+%[3]s
 `
 )
 
-type config struct {
-	APIToken        string   `json:"api_token"`
-	ClojureBinPath  string   `json:"clojure_bin_path"`
-	ReplHost        string   `json:"repl_host"`
-	ReplPort        int      `json:"repl_port"`
-	AllowedIds      []string `json:"allowed_ids"`
-	MonitorInterval int      `json:"monitor_interval"`
-	IsVerbose       bool     `json:"is_verbose,omitempty"`
-}
+// configFile is a config file, which has a config of a bot, or configs of multiple bots in `bots`
+type configFile struct {
+	bot.Config
 
-var _apiToken string
-var _clojureBinPath string
-var _replHost string
-var _replPort int
-var _monitorInterval int
-var _allowedIds []string
-var _isVerbose bool
-var _defaultKeyboards [][]telegram.KeyboardButton
+	Bots []bot.Config `json:"bots,omitempty"` // for running multiple bots in one process (other fields are ignored if set)
+}
 
 // read config file
-func openConfig(configFilepath string) (conf config, err error) {
+func openConfig(configFilepath string) (confs []bot.Config, err error) {
 	var bytes []byte
 	if bytes, err = os.ReadFile(configFilepath); err == nil {
-		if err = json.Unmarshal(bytes, &conf); err == nil {
-			return conf, nil
-		}
-	}
-
-	return config{}, err
-}
-
-// check if given Telegram id is allowed or not
-func isAllowedID(id *string) bool {
-	if id == nil {
-		return false
-	}
+		var file configFile
+		if err = json.Unmarshal(bytes, &file); err == nil {
+			if len(file.Bots) > 0 {
+				return file.Bots, nil
+			}
 
-	for _, v := range _allowedIds {
-		if v == *id {
-			return true
+			return []bot.Config{file.Config}, nil
 		}
 	}
 
-	return false
+	return nil, err
 }
 
 func main() {
@@ -92,185 +60,66 @@ func main() {
 		configFilepath := os.Args[1]
 
 		// read config
-		if conf, err := openConfig(configFilepath); err != nil {
+		confs, err := openConfig(configFilepath)
+		if err != nil {
 			panic(err)
-		} else {
-			_apiToken = conf.APIToken
-			_clojureBinPath = conf.ClojureBinPath
-			_replHost = conf.ReplHost
-			_replPort = conf.ReplPort
-
-			if conf.MonitorInterval <= 0 {
-				conf.MonitorInterval = defaultMonitorInterval
-			}
-			_monitorInterval = conf.MonitorInterval
-			_allowedIds = conf.AllowedIds
-			_isVerbose = conf.IsVerbose
-		}
-
-		_defaultKeyboards = [][]telegram.KeyboardButton{
-			{
-				telegram.NewKeyboardButton(commandPublics),
-				telegram.NewKeyboardButton(commandReset),
-			},
 		}
 
-		// create a client
-		client := repl.NewClient(_clojureBinPath, _replHost, _replPort)
-		client.Verbose = _isVerbose
-
-		// catch SIGINT and SIGTERM and terminate gracefully
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-		go func(client *repl.Client) {
-			<-sig
-			client.Shutdown() // shutdown client
-			os.Exit(1)
-		}(client)
-
-		bot := telegram.NewClient(_apiToken)
-		bot.Verbose = _isVerbose
-
-		// get info about this bot
-		if me := bot.GetMe(); me.Ok {
-			log.Printf("starting bot: @%s (%s)", *me.Result.Username, me.Result.FirstName)
-
-			// delete webhook (getting updates will not work when wehbook is set up)
-			if unhooked := bot.DeleteWebhook(true); unhooked.Ok {
-				// wait for new updates
-				bot.StartMonitoringUpdates(0, _monitorInterval, func(b *telegram.Bot, update telegram.Update, err error) {
-					if err == nil {
-						handleUpdate(b, update, client)
-					} else {
-						log.Printf("error while receiving update: %s", err.Error())
-					}
-				})
-			} else {
-				panic("failed to delete webhook")
+		// validate configs
+		for i, conf := range confs {
+			if err := conf.Validate(); err != nil {
+				if len(confs) > 1 {
+					fmt.Printf(invalidBotConfigFormat, configFilepath, i, err)
+				} else {
+					fmt.Printf(invalidConfigFormat, configFilepath, err)
+				}
+				os.Exit(1)
 			}
-		} else {
-			panic("failed to get info of the bot")
 		}
-	} else {
-		fmt.Printf(usageTextFormat, filepath.Base(os.Args[0]))
-	}
-}
 
-// handle received update from Telegram server
-func handleUpdate(b *telegram.Bot, update telegram.Update, client *repl.Client) {
-	if update.HasMessage() || update.HasEditedMessage() {
-		var message *telegram.Message
-		if update.HasMessage() {
-			message = update.Message
-		} else { // if update.HasEditedMessage() {
-			message = update.EditedMessage
+		// create bots
+		bots := []*bot.Bot{}
+		for _, conf := range confs {
+			b, err := bot.New(conf)
+			if err != nil {
+				panic(err)
+			}
+			bots = append(bots, b)
 		}
 
-		messageID := message.MessageID
-
-		var msg string
-		username := message.From.Username
-		if !isAllowedID(username) { // check if this user is allowed to use this bot
-			if username == nil {
-				log.Printf("received an update from an unauthorized user: '%s'", message.From.FirstName)
+		// catch SIGINT and SIGTERM and terminate gracefully
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-				msg = fmt.Sprintf("'%s' is not allowed to use this bot.", message.From.FirstName)
-			} else {
-				log.Printf("received an update from an unauthorized user: @%s", *username)
+		// run bots (when one of them fails, stop all of them)
+		var wg sync.WaitGroup
+		errs := make([]error, len(bots))
+		for i, b := range bots {
+			wg.Add(1)
+			go func(i int, b *bot.Bot) {
+				defer wg.Done()
 
-				msg = fmt.Sprintf("@%s is not allowed to use this bot.", *username)
-			}
-		} else {
-			// 'is typing...'
-			b.SendChatAction(message.Chat.ID, telegram.ChatActionTyping, nil)
+				if errs[i] = b.Run(ctx); errs[i] != nil {
+					log.Printf("bot[%d] stopped with error: %s", i, errs[i])
 
-			if message.HasText() {
-				switch *message.Text {
-				case commandStart:
-					msg = messageWelcome
-				case commandPublics:
-					if received, err := client.Eval(repl.CommandPublics); err == nil {
-						msg = repl.RespToString(received)
-					} else {
-						msg = messageFailedToListPublics
-					}
-				case commandReset:
-					if received, err := client.Eval(repl.CommandReset); err == nil {
-						if len(received) > 0 {
-							r := received[0]
-							msg = fmt.Sprintf("%s=> %s", r.Namespace, r.Value)
-						} else {
-							msg = messageErrorNothingReceived
-						}
-					} else {
-						msg = messageFailedToReset
-					}
-				default:
-					if received, err := client.Eval(*message.Text); err == nil {
-						msg = repl.RespToString(received)
-					} else {
-						msg = fmt.Sprintf("error: %s", err)
-					}
+					stop()
 				}
-			} else if message.HasDocument() {
-				fileResult := b.GetFile(message.Document.FileID)
-				fileURL := b.GetFileURL(*fileResult.Result)
-
-				// download the file (as temporary)
-				if filepath, err := downloadTemporarily(fileURL); err == nil {
-					if received, err := client.LoadFile(filepath); err == nil {
-						msg = repl.RespToString(received)
-
-						// and delete it
-						if err := os.Remove(filepath); err != nil {
-							log.Printf("failed to delete file %s: %s", filepath, err)
-						}
-					} else {
-						msg = fmt.Sprintf("failed to load file: %s", err)
-					}
-				} else {
-					msg = fmt.Sprintf("failed to download the document: %s", err)
-				}
-			} else {
-				msg = "error: couldn't process your message."
-			}
+			}(i, b)
 		}
+		wg.Wait()
 
-		// send message
-		msg = strings.TrimSpace(msg)
-		if msg != "" {
-			if sent := b.SendMessage(message.Chat.ID, msg, telegram.OptionsSendMessage{}.
-				SetReplyParameters(telegram.NewReplyParameters(messageID)).
-				SetReplyMarkup(telegram.NewReplyKeyboardMarkup(_defaultKeyboards). // show keyboards
-													SetResizeKeyboard(true))); !sent.Ok {
-				log.Printf("failed to send message: %s", *sent.Description)
-			}
+		// shutdown clients
+		for _, b := range bots {
+			b.Stop()
 		}
-	} else {
-		log.Printf("received update has no processable message")
-	}
-}
-
-// download given url
-func downloadTemporarily(url string) (filepath string, err error) {
-	tokens := strings.Split(url, "/")
-	filename := tokens[len(tokens)-1] // get the last path segment
 
-	filepath = path.Join(tempDir, filename)
-
-	var f *os.File
-	if f, err = os.Create(filepath); err == nil {
-		defer f.Close()
-
-		var response *http.Response
-		if response, err = http.Get(url); err == nil {
-			defer response.Body.Close()
-
-			if _, err = io.Copy(f, response.Body); err == nil {
-				return filepath, nil
+		for _, err := range errs {
+			if err != nil {
+				fmt.Printf(runFailedFormat, err)
+				os.Exit(1)
 			}
 		}
+	} else {
+		fmt.Printf(usageTextFormat, filepath.Base(os.Args[0]))
 	}
-
-	return "", err
 }
@@ -4,6 +4,8 @@ package repl
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,8 +13,10 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"olympos.io/encoding/edn"
@@ -23,21 +27,75 @@ const (
 	replConnectTimeoutSeconds = 10
 	replBootupTimeoutSeconds  = 60
 
-	numBytes            = 10 * 1024 // 10 kb
-	numRetries          = 10        // retry upto 10 times
-	timeoutMilliseconds = 1000      // 1 second
+	idleCheckInterval = 10 * time.Second
+
+	numBytes               = 10 * 1024 // 10 kb
+	responseTimeoutSeconds = 60        // hard deadline for reading responses
+	quietMilliseconds      = 100       // wait for more responses after complete ones
 )
 
 // Operations and commands
 const (
 	// commands
 	CommandRequireRepl    = `(require '[clojure.repl :refer :all])`
-	CommandSetPrintLength = `(set! *print-length* 20)`
-	CommandPublics        = `(clojure.string/join ", " (map first (ns-publics (ns-name *ns*))))`
+	CommandSetPrintLength = `(set! *print-length* ` + DefaultPrintLength + `)`
+	CommandPublics        = `(doseq [n (sort (keys (ns-publics *ns*)))] (println n))`
 	CommandReset          = `(map #(ns-unmap *ns* %) (keys (ns-interns *ns*)))`
 	CommandShutdown       = `(System/exit 0)`
+	CommandPing           = `nil`
+	CommandPrintLength    = `*print-length*`
+	CommandSelfTest       = `(+ 1 1)`
+	CommandNow            = `[(.toEpochMilli (java.time.Instant/now)) (str (java.time.ZoneId/systemDefault))]`
+	CommandPst            = `(if *e (clojure.repl/pst *e) ` + ValueNoException + `)`
+	CommandDump           = `(do (require 'clojure.repl) (doseq [s (sort (keys (ns-interns *ns*))) :let [src (clojure.repl/source-fn (symbol (str (ns-name *ns*)) (str s)))] :when src] (println src) (println)))`
+	CommandRunTests       = `(do (require 'clojure.test) (clojure.test/run-tests))`
+	CommandNamespaces     = `(doseq [n (sort (map ns-name (all-ns)))] (println n))`
+
+	// command formats
+	CommandFormatEnterSandbox   = `(do (when-not (find-ns '%[1]s) (create-ns '%[1]s) (binding [*ns* (the-ns '%[1]s)] (refer-clojure) (require '[clojure.repl :refer :all]))) (in-ns '%[1]s))`
+	CommandFormatRemoveNs       = `(remove-ns '%s)`
+	CommandFormatRestoreNs      = `(do (when-not (find-ns '%[1]s) (create-ns '%[1]s) (binding [*ns* (the-ns '%[1]s)] (refer-clojure))) (in-ns '%[1]s))`
+	CommandFormatEnterNs        = `(do (when-not (find-ns '%[1]s) (try (require '%[1]s) (catch java.io.FileNotFoundException _ (binding [*ns* (create-ns '%[1]s)] (refer-clojure))))) (in-ns '%[1]s))`
+	CommandFormatLoadFileInNs   = `(let [r (load-file %[2]s)] (in-ns '%[1]s) r)`
+	CommandFormatRequire        = `(require '[%s])`
+	CommandFormatRunTests       = `(do (require 'clojure.test) (clojure.test/run-tests '%s))`
+	CommandFormatSetPrintLength = `(set! *print-length* %s)`
+	CommandFormatDefAs          = `(do (def %[1]s %[2]s) %[1]s)`
+	CommandFormatType           = `(let [v (do %s)] [(pr-str v) (pr-str (type v))])`
+	CommandFormatMacroexpand    = `(do (require 'clojure.pprint) (clojure.pprint/pprint (%[1]s (binding [*read-eval* false] (read-string %[2]s)))))`
+	CommandFormatDeref          = `(let [v (do %s)] (if (instance? clojure.lang.IDeref v) (deref v) ` + ValueNotDerefable + `))`
+	CommandFormatCapture        = `(with-out-str (do %s))`
+	CommandFormatReadEdnFile    = `(do (require 'clojure.edn 'clojure.pprint) (clojure.pprint/pprint (clojure.edn/read-string (slurp "%s"))))`
+	CommandFormatCompletions    = `(vec (sort (distinct (filter #(.startsWith ^String %% "%s") (concat (map str (keys (ns-map *ns*))) (map (comp str ns-name) (all-ns)) (for [n (all-ns) s (keys (ns-publics n))] (str (ns-name n) "/" s))))))))`
+	CommandFormatFindDoc        = `(clojure.repl/find-doc %s)`
+	CommandFormatMeta           = `(if-let [v (resolve '%s)] (do (require 'clojure.pprint) (clojure.pprint/pprint (update (meta v) :ns #(some-> %% ns-name)))) ` + ValueUnresolved + `)`
+	CommandFormatAddLib         = `(if-let [add-lib (try (require 'clojure.repl.deps) (resolve 'clojure.repl.deps/add-lib) (catch Exception _ nil))] (with-bindings {(resolve 'clojure.core/*repl*) true} (add-lib '%[1]s {:mvn/version "%[2]s"})) ` + ValueUnsupported + `)`
+	CommandFormatShell          = `(do (require 'clojure.java.shell) (let [f (future (clojure.java.shell/sh %[1]s)) r (deref f %[2]d nil) t #(subs %% 0 (min (count %%) %[3]d))] (if r [(:exit r) (t (:out r)) (t (:err r)) (count (:out r)) (count (:err r))] (do (future-cancel f) ` + ValueTimeout + `))))`
+
+	// values
+	ValueUnsupported  = `:unsupported`
+	ValueUnresolved   = `:unresolved`
+	ValueNoException  = `:no-exception`
+	ValueNotDerefable = `:not-derefable`
+	ValueTimeout      = `:timeout`
+	ValueSelfTest     = `2` // expected result of `CommandSelfTest`
+
+	// default values
+	DefaultPrintLength = `20`
 )
 
+// DefaultInitForms are evaluated on initialization of PREPL, if not set with `SetInitForms`
+var DefaultInitForms = []string{
+	CommandRequireRepl,
+	CommandSetPrintLength,
+}
+
+// ErrNotConnected is returned when there is no connection to PREPL
+var ErrNotConnected = errors.New("not connected to PREPL")
+
+// ErrNoRequestInFlight is returned when there is no request which can read inputs
+var ErrNoRequestInFlight = errors.New("no evaluation is in flight")
+
 // Response is a response from PREPL
 type Response struct {
 	Tag          edn.Keyword `edn:"tag"`
@@ -53,6 +111,9 @@ type Response struct {
 type ExceptionValue struct {
 	Cause string      `edn:"cause"`
 	Phase edn.Keyword `edn:"phase"`
+	Via   []struct {
+		Type edn.Symbol `edn:"type"`
+	} `edn:"via"`
 }
 
 // Client is a PREPL client
@@ -61,103 +122,505 @@ type Client struct {
 	host           string
 	port           int
 
-	conn net.Conn
+	conn        net.Conn
+	connected   atomic.Bool // whether `conn` is set (for checking it without waiting for the lock held by evaluations)
+	launched    bool        // whether PREPL was launched by this client or not
+	neverLaunch bool        // only connect to an existing PREPL, never launch one
+
+	idleTimeout time.Duration
+	lastActive  time.Time
+
+	initForms   []string // forms to evaluate on initialization
+	autoRequire []string // namespaces to require on initialization
+
+	connectedBefore bool            // whether this client has ever been connected to PREPL
+	restorer        func() []string // returns forms for restoring states (eg. namespaces) after reconnection
+
+	process    *exec.Cmd   // the launched PREPL process
+	processLog *processLog // outputs of the launched PREPL process
+
+	inputConn  net.Conn    // connection of the request in flight (for writing inputs to `*in*`)
+	inputToken *InputToken // input token of the request in flight
+	inputLock  sync.Mutex  // (separated from the client's lock, which is held while requests are in flight)
+
 	sync.Mutex
 
-	Verbose bool
+	Verbose   bool
+	LogOutput bool // log outputs of the launched PREPL process
+}
+
+// NewClient returns a new client which is connected to (or has launched) PREPL
+//
+// (DefaultInitForms are evaluated; for other init forms, use `NewLazyClient` with `SetInitForms` and `Connect`)
+func NewClient(clojureBinPath, host string, port int) (*Client, error) {
+	client := NewLazyClient(clojureBinPath, host, port)
+
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+
+	return client, nil
 }
 
-// NewClient returns a new client
-func NewClient(clojureBinPath, host string, port int) *Client {
-	addr := fmt.Sprintf("%s:%d", host, port)
+// NewConnectOnlyClient returns a new client which is connected to an existing PREPL
+// (returns an error if it cannot connect, without launching a new one)
+func NewConnectOnlyClient(host string, port int) (*Client, error) {
+	client := NewLazyConnectOnlyClient(host, port)
+
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
 
-	client := Client{
+// NewLazyClient returns a new client which connects to (or launches) PREPL lazily on the first evaluation
+func NewLazyClient(clojureBinPath, host string, port int) *Client {
+	client := &Client{
 		clojureBinPath: clojureBinPath,
 		host:           host,
 		port:           port,
 		conn:           nil,
+		lastActive:     time.Now(),
+		initForms:      DefaultInitForms,
 	}
+	client.processLog = newProcessLog(&client.LogOutput)
+
+	return client
+}
+
+// NewLazyConnectOnlyClient returns a new client which connects to an existing PREPL lazily on the first evaluation
+// (never launches a new one)
+func NewLazyConnectOnlyClient(host string, port int) *Client {
+	client := NewLazyClient("", host, port)
+	client.neverLaunch = true
+
+	return client
+}
+
+// Connect connects to (or launches) PREPL now, instead of on the first evaluation,
+// and initializes it with init forms and auto-required namespaces which were set so far.
+func (c *Client) Connect() error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.reconnectIfNeeded()
+}
+
+// InputToken identifies an evaluation which can read inputs written with `WriteInput`
+type InputToken struct {
+	written chan struct{}
+	once    sync.Once
+}
+
+// NewInputToken returns a new input token
+func NewInputToken() *InputToken {
+	return &InputToken{
+		written: make(chan struct{}),
+	}
+}
+
+// Written returns a channel which is closed when the evaluation with this token has been written to PREPL
+// (not when it is queued behind other evaluations)
+func (t *InputToken) Written() <-chan struct{} {
+	return t.written
+}
+
+// mark that the evaluation with this token has been written
+func (t *InputToken) markWritten() {
+	t.once.Do(func() {
+		close(t.written)
+	})
+}
+
+// context key for input tokens
+type inputTokenKey struct{}
+
+// WithInputToken returns a context with given input token,
+// so that the evaluation with it can read inputs written with the token
+func WithInputToken(ctx context.Context, token *InputToken) context.Context {
+	return context.WithValue(ctx, inputTokenKey{}, token)
+}
+
+// input token of given context (nil if none)
+func inputTokenOf(ctx context.Context) *InputToken {
+	token, _ := ctx.Value(inputTokenKey{}).(*InputToken)
+	return token
+}
+
+// WriteInput writes the first line of given text to `*in*` of the evaluation in flight (eg. for `read-line`),
+// only when it is the evaluation with given token (so inputs are not written to evaluations of others)
+//
+// (it does not wait for the client's lock, which is held by the evaluation)
+func (c *Client) WriteInput(token *InputToken, text string) (err error) {
+	line, _, _ := strings.Cut(text, "\n") // (following lines would be read as forms by PREPL)
+
+	c.inputLock.Lock()
+
+	if c.inputConn == nil || token == nil || c.inputToken != token {
+		err = ErrNoRequestInFlight
+	} else {
+		_, err = c.inputConn.Write([]byte(strings.TrimRight(line, "\r") + "\n"))
+	}
+
+	c.inputLock.Unlock()
+
+	return err
+}
+
+// ProcessOutputs returns the last `n` lines of outputs (stdout and stderr) of the launched PREPL process
+func (c *Client) ProcessOutputs(n int) []string {
+	return c.processLog.last(n)
+}
+
+// IsConnected checks if this client is connected to PREPL or not
+//
+// (it does not wait for the client's lock, which is held while evaluations are in flight)
+func (c *Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+// address of PREPL
+func (c *Client) addr() string {
+	return net.JoinHostPort(c.host, strconv.Itoa(c.port))
+}
+
+// connect to an existing PREPL, or launch a new one if there is none
+func (c *Client) connect() error {
+	addr := c.addr()
 
 	// wait for PREPL
 	for i := 0; i < replConnectTimeoutSeconds; i++ {
 		time.Sleep(1 * time.Second)
 		if conn, err := net.Dial("tcp", addr); err == nil {
-			client.conn = conn
+			c.setConn(conn)
+			c.connectedBefore = true
 
 			log.Printf("there is an existing PREPL on: %s", addr)
-			break
+
+			return nil
 		}
+	}
 
-		if i == (replConnectTimeoutSeconds - 1) {
-			log.Printf("failed to connect to existing PREPL connection, trying to launch: %s", client.clojureBinPath)
-
-			// start a new PREPL server
-			replCmd := exec.Command(
-				client.clojureBinPath,
-				fmt.Sprintf(`-J-Dclojure.server.jvm={:address "%s" :port %d :accept clojure.core.server/io-prepl}`, client.host, client.port),
-			)
-			go func(cmd *exec.Cmd) {
-				cmd.Stdin = os.Stdin
-				if err := cmd.Run(); err != nil {
-					if cmd.Stderr != nil {
-						panic(cmd.Stderr)
-					}
+	if c.neverLaunch {
+		return fmt.Errorf("failed to connect to existing PREPL connection on %s (launching is disabled)", addr)
+	}
 
-					panic(err)
-				}
+	log.Printf("failed to connect to existing PREPL connection, trying to launch: %s", c.clojureBinPath)
 
-				log.Printf("PREPL exited...")
-			}(replCmd)
+	return c.launch()
+}
 
-			log.Printf("waiting for PREPL to bootup...")
+// launch a new PREPL and connect to it
+func (c *Client) launch() error {
+	addr := c.addr()
+
+	// start a new PREPL server
+	replCmd := exec.Command(
+		c.clojureBinPath,
+		fmt.Sprintf(`-J-Dclojure.server.jvm={:address "%s" :port %d :accept clojure.core.server/io-prepl}`, c.host, c.port),
+	)
+	replCmd.Stdout = c.processLog
+	replCmd.Stderr = c.processLog
+	c.process = replCmd
+	exited := make(chan struct{})
+	go func(cmd *exec.Cmd) {
+		cmd.Stdin = os.Stdin
+		if err := cmd.Run(); err != nil {
+			log.Printf("PREPL exited with error (%s), last outputs:\n%s", err, strings.Join(c.processLog.last(maxProcessLogLinesOnError), "\n"))
+		} else {
+			log.Printf("PREPL exited...")
+		}
+		close(exited)
 
-			// wait for PREPL
-			for i := 0; i < replBootupTimeoutSeconds; i++ {
-				log.Printf("connecting to PREPL on: %s", addr)
+		// drop the connection to the exited process, so that it will be relaunched on the next request
+		c.Lock()
+		if c.process == cmd { // (not relaunched yet)
+			c.drop()
+		}
+		c.Unlock()
+	}(replCmd)
 
-				time.Sleep(1 * time.Second)
-				if conn, err := net.Dial("tcp", addr); err == nil {
-					client.conn = conn
+	log.Printf("waiting for PREPL to bootup...")
 
-					log.Printf("connected to PREPL on: %s", addr)
+	// wait for PREPL
+	for i := 0; i < replBootupTimeoutSeconds; i++ {
+		log.Printf("connecting to PREPL on: %s", addr)
 
-					client.initialize()
+		select {
+		case <-exited:
+			return fmt.Errorf("launched PREPL exited before accepting connections: %s", addr)
+		case <-time.After(1 * time.Second):
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			c.setConn(conn)
+			c.launched = true
+			c.connectedBefore = true
 
-					break
-				}
+			log.Printf("connected to PREPL on: %s", addr)
 
-				if i == (replBootupTimeoutSeconds - 1) {
-					panic("failed to connect to launched PREPL: " + addr)
-				}
+			c.initialize()
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to connect to launched PREPL: %s", addr)
+}
+
+// connect to PREPL if it is not connected yet (lazy client), or relaunch it (shut down due to idle timeout)
+//
+// NOTE: should be called while locked
+func (c *Client) reconnectIfNeeded() (err error) {
+	if c.conn != nil {
+		return nil
+	}
+
+	reconnecting, initialized := c.connectedBefore, false
+
+	if c.launched {
+		// the launched PREPL may still be alive (eg. only the connection was dropped)
+		if conn, dialErr := net.Dial("tcp", c.addr()); dialErr == nil {
+			c.setConn(conn)
+		} else {
+			log.Printf("relaunching PREPL...")
+
+			err, initialized = c.launch(), true
+		}
+	} else {
+		err = c.connect()
+		initialized = c.launched
+	}
+
+	if err == nil {
+		if !reconnecting {
+			c.selfTest()
+		}
+
+		// (also on the first connection, as an existing PREPL is not initialized by this client)
+		c.restore(initialized)
+	}
+
+	return err
+}
+
+// evaluate a known form and verify its result, for warning about misconfiguration (eg. connected to a non-clj REPL)
+//
+// NOTE: should be called while locked
+func (c *Client) selfTest() {
+	responses, err := c.sendAndRecvSingle(context.Background(), CommandSelfTest)
+	if err == nil && !HasException(responses) {
+		for _, r := range responses {
+			if r.Tag == "ret" && strings.TrimSpace(r.Value) == ValueSelfTest {
+				log.Printf("self-test passed: %s => %s", CommandSelfTest, ValueSelfTest)
+				return
 			}
 		}
 	}
 
-	return &client
+	if err != nil {
+		log.Printf("WARNING: self-test failed (`%s` => %s), REPL may be misconfigured (eg. wrong language or version)", CommandSelfTest, err)
+	} else {
+		log.Printf("WARNING: self-test failed (`%s` => %s), REPL may be misconfigured (eg. wrong language or version)", CommandSelfTest, RespToString(responses))
+	}
+}
+
+// restore states (print length, auto-required namespaces, and forms from the restorer) after (re)connection
+//
+// NOTE: should be called while locked
+func (c *Client) restore(initialized bool) {
+	forms := []string{}
+	if !initialized { // (a newly launched PREPL is initialized already)
+		forms = append(forms, c.initForms...)
+		for _, ns := range c.autoRequire {
+			forms = append(forms, fmt.Sprintf(CommandFormatRequire, ns))
+		}
+	}
+	if c.restorer != nil {
+		forms = append(forms, c.restorer()...)
+	}
+
+	for _, form := range forms {
+		if responses, err := c.sendAndRecvSingle(context.Background(), form); err != nil {
+			log.Printf("failed to restore with `%s`: %s", form, err)
+		} else if HasException(responses) {
+			log.Printf("failed to restore with `%s`: %s", form, RespToString(responses))
+		} else {
+			log.Printf("restored with `%s`", form)
+		}
+	}
+}
+
+// SetRestorer sets a function which returns forms to be evaluated for restoring states after reconnection.
+//
+// (it is called while this client is locked, so it should not call any method of this client)
+func (c *Client) SetRestorer(restorer func() []string) {
+	c.Lock()
+	c.restorer = restorer
+	c.Unlock()
 }
 
 // initialize this client
+//
+// NOTE: should be called while locked
 func (c *Client) initialize() {
-	for _, cmd := range []string{
-		CommandRequireRepl,
-		CommandSetPrintLength,
-		// TODO - add more initialization codes here
-	} {
-		if _, err := c.Eval(cmd); err != nil {
-			log.Printf("failed to evaluate `%s`: %s", cmd, err)
+	c.evalInitForms(c.initForms)
+
+	c.requireNamespaces(c.autoRequire)
+}
+
+// evaluate given initialization forms one by one (failures are logged, not returned)
+//
+// NOTE: should be called while locked
+func (c *Client) evalInitForms(forms []string) {
+	for _, form := range forms {
+		if responses, err := c.sendAndRecvSingle(context.Background(), form); err != nil {
+			log.Printf("failed to evaluate `%s`: %s", form, err)
+		} else if HasException(responses) {
+			log.Printf("failed to evaluate `%s`: %s", form, RespToString(responses))
+		} else {
+			log.Printf("evaluated `%s`", form)
+		}
+	}
+}
+
+// SetInitForms sets forms to be evaluated in order on every initialization of PREPL
+// (replacing DefaultInitForms).
+//
+// If already connected, they are evaluated immediately.
+func (c *Client) SetInitForms(forms []string) {
+	c.Lock()
+
+	c.initForms = forms
+	if c.conn != nil {
+		c.evalInitForms(forms)
+	}
+
+	c.Unlock()
+}
+
+// require given namespaces one by one (failures are logged, not returned)
+//
+// NOTE: should be called while locked
+func (c *Client) requireNamespaces(namespaces []string) {
+	for _, ns := range namespaces {
+		if responses, err := c.sendAndRecvSingle(context.Background(), fmt.Sprintf(CommandFormatRequire, ns)); err != nil {
+			log.Printf("failed to require namespace `%s`: %s", ns, err)
+		} else if HasException(responses) {
+			log.Printf("failed to require namespace `%s`: %s", ns, RespToString(responses))
+		}
+	}
+}
+
+// SetAutoRequire sets namespaces to be required on every initialization of PREPL.
+//
+// If already connected, they are required immediately.
+func (c *Client) SetAutoRequire(namespaces []string) {
+	valid := []string{}
+	for _, ns := range namespaces {
+		if reNamespace.MatchString(ns) {
+			valid = append(valid, ns)
+		} else {
+			log.Printf("ignoring invalid namespace for auto-require: %s", ns)
 		}
 	}
+
+	c.Lock()
+
+	c.autoRequire = valid
+	if c.conn != nil {
+		c.requireNamespaces(valid)
+	}
+
+	c.Unlock()
+}
+
+// SetIdleTimeout sets the idle timeout of this client.
+//
+// If PREPL was launched by this client and no evaluation happens for given duration,
+// it will be shut down, and then relaunched lazily on the next evaluation.
+func (c *Client) SetIdleTimeout(timeout time.Duration) {
+	c.Lock()
+	c.idleTimeout = timeout
+	c.lastActive = time.Now()
+	c.Unlock()
+
+	if timeout > 0 {
+		go c.watchIdle(timeout)
+	}
+}
+
+// watch idle time and shut down the launched PREPL when it is idle for too long
+func (c *Client) watchIdle(timeout time.Duration) {
+	interval := idleCheckInterval
+	if timeout < interval {
+		interval = timeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.Lock()
+
+		if c.idleTimeout != timeout { // idle timeout was changed
+			c.Unlock()
+			return
+		}
+
+		if c.conn != nil && c.launched && time.Since(c.lastActive) > timeout {
+			log.Printf("PREPL has been idle for %s, shutting down...", timeout)
+
+			c.shutdown()
+		}
+
+		c.Unlock()
+	}
 }
 
 // Eval evaluates given code
 func (c *Client) Eval(code string) (responses []Response, err error) {
+	return c.EvalContext(context.Background(), code)
+}
+
+// EvalContext evaluates given code with context
+func (c *Client) EvalContext(ctx context.Context, code string) (responses []Response, err error) {
 	c.Lock()
 
 	if c.Verbose {
 		log.Printf("will evaluate `%s`", code)
 	}
 
-	responses, err = c.sendAndRecv(code)
+	if err = c.reconnectIfNeeded(); err == nil {
+		responses, err = c.sendAndRecv(ctx, code)
+	}
+	c.lastActive = time.Now()
+
+	if c.Verbose {
+		log.Printf("evaluated `%s`: %+v", code, responses)
+	}
+
+	c.Unlock()
+
+	return responses, err
+}
+
+// EvalAfter evaluates given code after evaluating `setupForm` (eg. for switching namespace),
+// whose responses are discarded
+// (both are evaluated at once, so other evaluations cannot interleave between them)
+func (c *Client) EvalAfter(ctx context.Context, setupForm, code string) (responses []Response, err error) {
+	c.Lock()
+
+	if c.Verbose {
+		log.Printf("will evaluate `%s` after `%s`", code, setupForm)
+	}
+
+	if err = c.reconnectIfNeeded(); err == nil {
+		if _, err = c.sendAndRecvSingle(WithInputToken(ctx, nil), setupForm); err == nil { // (setup form does not read inputs)
+			responses, err = c.sendAndRecv(ctx, code)
+		}
+	}
+	c.lastActive = time.Now()
 
 	if c.Verbose {
 		log.Printf("evaluated `%s`: %+v", code, responses)
@@ -168,15 +631,34 @@ func (c *Client) Eval(code string) (responses []Response, err error) {
 	return responses, err
 }
 
+// LoadFileInNamespace loads given file in given namespace (created if it does not exist),
+// and stays in it after loading
+func (c *Client) LoadFileInNamespace(filepath, ns string) (responses []Response, err error) {
+	if !reNamespace.MatchString(ns) {
+		return nil, fmt.Errorf("invalid namespace: %s", ns)
+	}
+
+	// (`load-file` restores the namespace after loading, so switch to it again)
+	return c.EvalAfter(context.Background(), fmt.Sprintf(CommandFormatRestoreNs, ns), fmt.Sprintf(CommandFormatLoadFileInNs, ns, QuoteString(filepath)))
+}
+
 // LoadFile loads given file
 func (c *Client) LoadFile(filepath string) (responses []Response, err error) {
+	return c.LoadFileContext(context.Background(), filepath)
+}
+
+// LoadFileContext loads given file with context
+func (c *Client) LoadFileContext(ctx context.Context, filepath string) (responses []Response, err error) {
 	c.Lock()
 
 	if c.Verbose {
 		log.Printf("will load file `%s`", filepath)
 	}
 
-	responses, err = c.sendAndRecv(fmt.Sprintf(`(load-file "%s")`, filepath))
+	if err = c.reconnectIfNeeded(); err == nil {
+		responses, err = c.sendAndRecv(ctx, fmt.Sprintf(`(load-file "%s")`, filepath))
+	}
+	c.lastActive = time.Now()
 
 	if c.Verbose {
 		log.Printf("loaded file `%s`: %+v", filepath, responses)
@@ -187,64 +669,257 @@ func (c *Client) LoadFile(filepath string) (responses []Response, err error) {
 	return responses, err
 }
 
+// ReadEdnFile reads given edn file and pretty-prints its data
+func (c *Client) ReadEdnFile(filepath string) (responses []Response, err error) {
+	c.Lock()
+
+	if c.Verbose {
+		log.Printf("will read edn file `%s`", filepath)
+	}
+
+	if err = c.reconnectIfNeeded(); err == nil {
+		responses, err = c.sendAndRecv(context.Background(), fmt.Sprintf(CommandFormatReadEdnFile, filepath))
+	}
+	c.lastActive = time.Now()
+
+	if c.Verbose {
+		log.Printf("read edn file `%s`: %+v", filepath, responses)
+	}
+
+	c.Unlock()
+
+	return responses, err
+}
+
+// Ping measures the round-trip time of a trivial evaluation
+//
+// (does not connect to or launch PREPL when not connected)
+func (c *Client) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	c.Lock()
+
+	if c.conn == nil {
+		err = ErrNotConnected
+	} else {
+		started := time.Now()
+		if _, err = c.sendAndRecvSingle(ctx, CommandPing); err == nil {
+			rtt = time.Since(started)
+		}
+	}
+
+	c.Unlock()
+
+	return rtt, err
+}
+
+// Completions returns sorted completion candidates for given prefix
+func (c *Client) Completions(prefix string) (candidates []string, err error) {
+	if !reCompletionPrefix.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid prefix: %s", prefix)
+	}
+
+	var responses []Response
+	if responses, err = c.Eval(fmt.Sprintf(CommandFormatCompletions, prefix)); err == nil {
+		for _, r := range responses {
+			if r.Tag == "ret" {
+				if r.Exception {
+					return nil, fmt.Errorf("%s", RespToString([]Response{r}))
+				}
+
+				if err = edn.Unmarshal([]byte(r.Value), &candidates); err == nil {
+					return candidates, nil
+				}
+
+				return nil, fmt.Errorf("failed to parse completions: %s", err)
+			}
+		}
+
+		return nil, fmt.Errorf("no completions received")
+	}
+
+	return nil, err
+}
+
 // Shutdown shuts down the REPL, it will be the best place for cleaning things up
 func (c *Client) Shutdown() {
 	c.Lock()
 
+	if c.conn != nil && c.neverLaunch { // (externally managed PREPL is left running)
+		c.drop()
+	} else if c.conn != nil {
+		c.shutdown()
+	}
+
+	c.Unlock()
+}
+
+// send shutdown command to PREPL and close the connection
+//
+// NOTE: should be called while locked
+func (c *Client) shutdown() {
 	log.Printf("sending shutdown command to REPL...")
 
-	if _, err := c.sendAndRecv(CommandShutdown); err != nil {
+	if _, err := c.sendAndRecv(context.Background(), CommandShutdown); err != nil {
 		log.Printf("failed to send shutdown command to REPL: %s", err)
 	}
 
 	log.Printf("closing connection to REPL...")
 
+	c.drop()
+}
+
+// close and discard the connection to PREPL
+//
+// NOTE: should be called while locked
+func (c *Client) drop() {
+	if c.conn == nil {
+		return
+	}
+
 	if err := c.conn.Close(); err != nil {
 		log.Printf("failed to close connection to REPL: %s", err)
 	}
 
-	c.Unlock()
+	c.setConn(nil)
+}
+
+// set the connection to PREPL (nil for disconnected)
+//
+// NOTE: should be called while locked
+func (c *Client) setConn(conn net.Conn) {
+	c.conn = conn
+	c.connected.Store(conn != nil)
 }
 
 // send request and receive response bytes from PREPL
-func (c *Client) sendAndRecvBytes(request string) (result []byte, err error) {
+//
+// Responses are complete when `numRets` `:ret`s (one for each top-level form of the request) are received,
+// or when they end with a `:ret` if `numRets` is not positive.
+// Reading continues until complete responses are received and nothing more arrives for a while
+// (eg. outputs printed right after returning), or the hard deadline is reached.
+// If `wait` is false, reading stops as soon as the responses are complete.
+//
+// (when given context is done, reading is unblocked and `ctx.Err()` is returned)
+func (c *Client) sendAndRecvBytes(ctx context.Context, request string, numRets int, wait bool) (result []byte, err error) {
 	buffer := bytes.NewBuffer([]byte{})
 
-	// set read timeout
-	if err = c.conn.SetReadDeadline(time.Now().Add(timeoutMilliseconds * time.Millisecond)); err != nil {
-		log.Printf("error while setting read deadline: %s", err)
+	if c.conn == nil {
+		return []byte{}, ErrNotConnected
+	}
 
+	if err = ctx.Err(); err != nil {
 		return []byte{}, err
 	}
 
+	// hard deadline for reading (or context's deadline, if it is earlier)
+	hardDeadline := time.Now().Add(responseTimeoutSeconds * time.Second)
+	if ctxDeadline, exists := ctx.Deadline(); exists && ctxDeadline.Before(hardDeadline) {
+		hardDeadline = ctxDeadline
+	}
+
+	// unblock reading when the context is done
+	conn := c.conn
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
 	if c.Verbose {
 		log.Printf("writing request: %s", request)
 	}
 
 	// send request (with trailing newline)
 	if _, err = c.conn.Write([]byte(request + "\n")); err == nil {
+		// inputs can be written while reading responses
+		token := inputTokenOf(ctx)
+		c.inputLock.Lock()
+		c.inputConn, c.inputToken = conn, token
+		c.inputLock.Unlock()
+		defer func() {
+			c.inputLock.Lock()
+			c.inputConn, c.inputToken = nil, nil
+			c.inputLock.Unlock()
+		}()
+		if token != nil {
+			token.markWritten()
+		}
+
 		// read response
 		buf := make([]byte, numBytes)
-		for n := 0; n < numRetries; n++ {
-			if numRead, readErr := c.conn.Read(buf); readErr == nil {
-				if numRead > 0 {
-					buffer.Write(buf[:numRead])
+		reader := responseReader{}
+		complete := false
+		for {
+			// wait shortly for more responses after complete ones, or until the hard deadline
+			deadline := hardDeadline
+			if complete {
+				if quiet := time.Now().Add(quietMilliseconds * time.Millisecond); quiet.Before(deadline) {
+					deadline = quiet
 				}
-			} else {
-				if readErr != io.EOF && !(readErr.(net.Error)).Timeout() {
-					log.Printf("error while reading bytes: %s", readErr)
+			}
+			if err = c.conn.SetReadDeadline(deadline); err != nil {
+				log.Printf("error while setting read deadline: %s", err)
+				break
+			}
+			if ctx.Err() != nil { // context was done before setting the deadline
+				break
+			}
+
+			numRead, readErr := c.conn.Read(buf)
+			if numRead > 0 {
+				buffer.Write(buf[:numRead])
+
+				if complete = reader.read(buffer.Bytes(), numRets); complete && !wait {
+					break
+				}
+			}
+
+			if readErr != nil {
+				if netErr, ok := readErr.(net.Error); ok && netErr.Timeout() {
+					if complete || !time.Now().Before(hardDeadline) || ctx.Err() != nil {
+						break
+					}
+				} else {
+					if readErr != io.EOF {
+						log.Printf("error while reading bytes: %s", readErr)
+					}
+
+					// connection was dropped, so reconnect on the next request
+					c.drop()
 					break
 				}
 			}
 		}
+
+		// timed out while the request is still in flight (eg. waiting for inputs),
+		// so drop the connection for not reading its remaining responses with the next request
+		if !complete && c.conn != nil && ctx.Err() == nil {
+			log.Printf("timed out while waiting for responses")
+
+			c.drop()
+		}
 	} else {
 		log.Printf("error while writing request: %s", err)
+
+		// connection was dropped, so reconnect on the next request
+		c.drop()
 	}
 
 	if c.Verbose {
 		log.Printf("read buffer: %+v", buffer)
 	}
 
+	// when the context is done while reading,
+	ctxErr := ctx.Err()
+	if ctxDeadline, exists := ctx.Deadline(); ctxErr == nil && exists && !time.Now().Before(ctxDeadline) {
+		ctxErr = context.DeadlineExceeded // (the deadline has passed, but the context may not be done yet)
+	}
+	if ctxErr != nil {
+		// drop the connection, so that the remaining responses will not be read by the next request
+		// (the evaluation itself may keep running in PREPL)
+		c.drop()
+
+		return []byte{}, ctxErr
+	}
+
 	// only when read buffer is filled up,
 	if buffer.Len() > 0 {
 		return cleanse(buffer.Bytes()), nil
@@ -253,23 +928,104 @@ func (c *Client) sendAndRecvBytes(request string) (result []byte, err error) {
 	return []byte{}, err
 }
 
+// reader of responses, which scans received bytes incrementally and decodes each response only once
+// (so that responses received in many chunks are not decoded again and again)
+type responseReader struct {
+	offset int // offset of the next byte to scan
+	start  int // offset of the response being scanned
+
+	depth    int  // depth of brackets
+	inString bool // whether scanning a string
+	escaped  bool // whether the previous byte was an escaping backslash in a string
+
+	numRets int         // number of decoded `:ret`s
+	lastTag edn.Keyword // tag of the last decoded response
+	failed  bool        // whether any response failed to be decoded
+}
+
+// scan newly appended bytes of given (accumulated) bytes, and check if they are complete responses,
+// which can be decoded and include `numRets` `:ret`s (or end with a `:ret`, if `numRets` is not positive)
+//
+// (outputs after the last expected `:ret`, eg. printed by futures, do not make them incomplete again)
+func (r *responseReader) read(bts []byte, numRets int) (complete bool) {
+	for ; r.offset < len(bts); r.offset++ {
+		switch b := bts[r.offset]; {
+		case r.escaped:
+			r.escaped = false
+		case r.inString:
+			if b == '\\' {
+				r.escaped = true
+			} else if b == '"' {
+				r.inString = false
+			}
+		case b == '"':
+			r.inString = true
+		case b == '{' || b == '[' || b == '(':
+			r.depth++
+		case b == '}' || b == ']' || b == ')':
+			if r.depth--; r.depth == 0 { // end of a top-level response
+				r.decode(bts[r.start : r.offset+1])
+				r.start = r.offset + 1
+			}
+		}
+	}
+
+	if r.failed || r.depth != 0 || len(bytes.TrimSpace(bts[r.start:])) > 0 { // (in the middle of a response)
+		return false
+	}
+	if numRets > 0 {
+		return r.numRets >= numRets
+	}
+
+	return r.lastTag == "ret"
+}
+
+// decode a response
+func (r *responseReader) decode(bts []byte) {
+	var response Response
+	if err := edn.Unmarshal(cleanse(bts), &response); err != nil {
+		r.failed = true
+		return
+	}
+
+	if response.Tag == "ret" {
+		r.numRets++
+	}
+	r.lastTag = response.Tag
+}
+
 // send request and receive response from PREPL
-func (c *Client) sendAndRecv(request string) (responses []Response, err error) {
+// (waits for a `:ret` of each top-level form in the request)
+func (c *Client) sendAndRecv(ctx context.Context, request string) (responses []Response, err error) {
+	forms, _ := SplitForms(request)
+
+	return c.sendAndRecvN(ctx, request, len(forms), true)
+}
+
+// send request with a single form and receive response from PREPL, without waiting for more responses
+func (c *Client) sendAndRecvSingle(ctx context.Context, request string) (responses []Response, err error) {
+	return c.sendAndRecvN(ctx, request, 1, false)
+}
+
+// send request and receive response from PREPL (see `sendAndRecvBytes` for `numRets` and `wait`)
+func (c *Client) sendAndRecvN(ctx context.Context, request string, numRets int, wait bool) (responses []Response, err error) {
 	responses = []Response{}
 
 	var bts []byte
-	if bts, err = c.sendAndRecvBytes(request); err == nil {
-		var r Response
-		for _, line := range bytes.Split(bts, []byte("\n")) {
-			// skip empty lines
-			if len(strings.TrimSpace(string(line))) <= 0 {
-				continue
-			}
-
-			if err = edn.Unmarshal(line, &r); err == nil {
+	if bts, err = c.sendAndRecvBytes(ctx, request, numRets, wait); err == nil {
+		// decode successive forms (not split by newlines, as strings may contain them)
+		decoder := edn.NewDecoder(bytes.NewReader(bts))
+		for {
+			var r Response
+			if err = decoder.Decode(&r); err == nil {
 				responses = append(responses, r)
 			} else {
-				log.Printf("failed to unmarshal received response: %+v (%s)", r, err)
+				if err == io.EOF {
+					err = nil
+				} else {
+					log.Printf("failed to decode received response: %s", err)
+				}
+				break
 			}
 		}
 	}
@@ -277,47 +1033,75 @@ func (c *Client) sendAndRecv(request string) (responses []Response, err error) {
 	return responses, err
 }
 
-// RespToString converts REPL response to string
-func RespToString(responses []Response) string {
-	msgs := []string{}
+// HasException checks if given responses include any exception
+func HasException(responses []Response) bool {
+	for _, r := range responses {
+		if r.Exception {
+			return true
+		}
+	}
+
+	return false
+}
 
+// HasStderr checks if given responses include any non-empty output to stderr
+func HasStderr(responses []Response) bool {
 	for _, r := range responses {
-		if r.Exception { // PREPL error exists
-			var exception ExceptionValue
-			if err := edn.Unmarshal([]byte(r.Value), &exception); err == nil {
-				msgs = append(msgs, strings.TrimSpace(exception.Cause))
-			} else {
-				errStr := fmt.Sprintf("failed to unmarshal exception value: %s", err)
+		if r.Tag == "err" && strings.TrimSpace(r.Value) != "" {
+			return true
+		}
+	}
 
-				log.Print(errStr)
+	return false
+}
 
-				switch r.Tag {
-				case "ret":
-					msgs = append(msgs, fmt.Sprintf("%s=> %s", r.Namespace, strings.TrimSpace(r.Value)))
-				case "out", "err":
-					msgs = append(msgs, strings.TrimSpace(r.Value))
-				default:
-					msgs = append(msgs, errStr)
-				}
-			}
-		} else {
-			switch r.Tag {
-			case "ret":
-				msgs = append(msgs, fmt.Sprintf("%s=> %s", r.Namespace, strings.TrimSpace(r.Value)))
-			case "out", "err":
-				msgs = append(msgs, strings.TrimSpace(r.Value))
-			default:
-				errStr := fmt.Sprintf("unhandled `%s` response: %+v", r.Tag, r)
+// regular expression for namespace names
+var reNamespace = regexp.MustCompile(`^[a-zA-Z*+!_?<>=-][a-zA-Z0-9*+!_?<>='.-]*$`)
 
-				log.Print(errStr)
+// IsValidNamespace checks if given string is a valid namespace name
+func IsValidNamespace(str string) bool {
+	return reNamespace.MatchString(str)
+}
 
-				msgs = append(msgs, errStr)
-			}
-		}
-	}
+// regular expression for (unqualified) symbols
+var reSymbol = regexp.MustCompile(`^[a-zA-Z*+!_?<>=-][a-zA-Z0-9*+!_?<>='-]*$`)
 
-	// join them
-	return strings.Join(msgs, "\n")
+// IsValidSymbol checks if given string is a valid (unqualified) symbol
+func IsValidSymbol(str string) bool {
+	return reSymbol.MatchString(str)
+}
+
+// regular expression for (optionally namespace-qualified) symbols
+var reQualifiedSymbol = regexp.MustCompile(`^([a-zA-Z*+!_?<>=-][a-zA-Z0-9*+!_?<>='.-]*/)?[a-zA-Z*+!_?<>=-][a-zA-Z0-9*+!_?<>='-]*$`)
+
+// IsValidQualifiedSymbol checks if given string is a valid (optionally namespace-qualified) symbol
+func IsValidQualifiedSymbol(str string) bool {
+	return reQualifiedSymbol.MatchString(str)
+}
+
+// QuoteString converts given string to a Clojure string literal
+func QuoteString(str string) string {
+	str = strings.ReplaceAll(str, `\`, `\\`)
+	str = strings.ReplaceAll(str, `"`, `\"`)
+
+	return `"` + str + `"`
+}
+
+// regular expression for completion prefixes
+var reCompletionPrefix = regexp.MustCompile(`^[a-zA-Z0-9*+!_?<>='./-]+$`)
+
+// regular expressions for library coordinates and versions
+var reLibCoord = regexp.MustCompile(`^[a-zA-Z0-9._-]+(/[a-zA-Z0-9._-]+)?$`)
+var reLibVersion = regexp.MustCompile(`^[a-zA-Z0-9._+-]+$`)
+
+// IsValidLibCoord checks if given string is a valid library coordinate (eg. `org.clojure/data.json`)
+func IsValidLibCoord(str string) bool {
+	return reLibCoord.MatchString(str)
+}
+
+// IsValidLibVersion checks if given string is a valid library version (eg. `2.5.0`)
+func IsValidLibVersion(str string) bool {
+	return reLibVersion.MatchString(str)
 }
 
 // following strings lead to go-edn's parser errors, so need to be replaced...
@@ -327,20 +1111,21 @@ var invalidStrings = []string{
 	"#object",
 }
 
-// regular expression for hex numbers
-var reHex = regexp.MustCompile(`(0x[0-9a-fA-F]+)`)
+// regular expression for hex addresses of objects (eg. `#object[clojure.lang.Atom 0x1a2b ...]`)
+var reObjectHex = regexp.MustCompile(`(#object\[[^\s\]]+\s+)(0x[0-9a-fA-F]+)`)
 
 // cleanse string (edn parser fails on some characters...)
 func cleanse(original []byte) (result []byte) {
 	result = original
 
+	// XXX - go-edn fails to parse hex numbers, so replace object addresses to strings
+	// (only the ones in `#object[...]`, so legitimate hex literals are left untouched)
+	result = reObjectHex.ReplaceAll(result, []byte(`$1\"$2\"`))
+
 	// XXX - remove invalid strings
 	for _, str := range invalidStrings {
 		result = bytes.ReplaceAll(result, []byte(str), []byte(""))
 	}
 
-	// XXX - go-edn fails to parse hex numbers, so replace them to strings
-	result = []byte(reHex.ReplaceAllString(string(result), `\"$1\"`))
-
 	return result
 }
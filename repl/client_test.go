@@ -0,0 +1,521 @@
+package repl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meinside/telegram-clojure-repl-bot/internal/prepltest"
+)
+
+// scripted responses which are needed by every client (eg. for self-tests)
+func scripted(responses map[string]string) map[string]string {
+	all := map[string]string{
+		CommandSelfTest: `{:tag :ret, :val "2", :ns "user", :ms 0, :form "(+ 1 1)"}`,
+	}
+	for input, response := range responses {
+		all[input] = response
+	}
+
+	return all
+}
+
+// start a fake PREPL server and a lazy client for it
+func newTestClient(t *testing.T, responses map[string]string) (*prepltest.Server, *Client) {
+	t.Helper()
+
+	server, err := prepltest.NewServer(scripted(responses))
+	if err != nil {
+		t.Fatalf("failed to start fake PREPL server: %s", err)
+	}
+
+	client := NewLazyConnectOnlyClient(server.Host(), server.Port())
+	client.initForms = nil
+
+	t.Cleanup(func() {
+		client.Shutdown()
+		_ = server.Close()
+	})
+
+	return server, client
+}
+
+func TestEval(t *testing.T) {
+	_, client := newTestClient(t, map[string]string{
+		`(do (println "hi") (+ 1 2))`: `{:tag :out, :val "hi\n"}
+{:tag :ret, :val "3", :ns "user", :ms 1, :form "(do (println \"hi\") (+ 1 2))"}`,
+	})
+
+	responses, err := client.Eval(`(do (println "hi") (+ 1 2))`)
+	if err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 responses, got %d: %+v", len(responses), responses)
+	}
+	if responses[0].Tag != "out" || responses[0].Value != "hi\n" {
+		t.Errorf("unexpected output: %+v", responses[0])
+	}
+	if responses[1].Tag != "ret" || responses[1].Value != "3" || responses[1].Namespace != "user" {
+		t.Errorf("unexpected return value: %+v", responses[1])
+	}
+}
+
+func TestEvalException(t *testing.T) {
+	_, client := newTestClient(t, map[string]string{
+		`(/ 1 0)`: `{:tag :ret, :val "{:cause \"Divide by zero\", :via [{:type java.lang.ArithmeticException}], :phase :execution}", :ns "user", :ms 0, :form "(/ 1 0)", :exception true}`,
+	})
+
+	responses, err := client.Eval(`(/ 1 0)`)
+	if err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+
+	if !HasException(responses) {
+		t.Errorf("expected an exception, got: %+v", responses)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	server, client := newTestClient(t, map[string]string{
+		`(load-file "/tmp/test.clj")`: `{:tag :ret, :val "#'user/f", :ns "user", :ms 3, :form "(load-file \"/tmp/test.clj\")"}`,
+	})
+
+	responses, err := client.LoadFile("/tmp/test.clj")
+	if err != nil {
+		t.Fatalf("failed to load file: %s", err)
+	}
+
+	if len(responses) != 1 || responses[0].Value != "#'user/f" {
+		t.Errorf("unexpected responses: %+v", responses)
+	}
+	if !slices.Contains(server.Received(), `(load-file "/tmp/test.clj")`) {
+		t.Errorf("`load-file` was not sent: %v", server.Received())
+	}
+}
+
+func TestEvalTimeout(t *testing.T) {
+	server, client := newTestClient(t, nil)
+	if _, err := client.Eval(`:connect`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	server.Delay = 2 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if _, err := client.EvalContext(ctx, `(Thread/sleep 10000)`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("evaluation was not unblocked on timeout (took %s)", elapsed)
+	}
+
+	// (the connection is dropped, for not reading remaining responses with the next request)
+	if client.IsConnected() {
+		t.Errorf("expected the connection to be dropped after timeout")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server, client := newTestClient(t, nil)
+	client.SetRestorer(func() []string {
+		return []string{`(in-ns 'restored)`}
+	})
+
+	if _, err := client.Eval(`:first`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	// drop the connection with a timed-out evaluation
+	server.Delay = 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, _ = client.EvalContext(ctx, `(Thread/sleep 10000)`)
+	cancel()
+
+	if client.IsConnected() {
+		t.Fatalf("expected the connection to be dropped")
+	}
+
+	// the next evaluation reconnects, and restores states before evaluating
+	responses, err := client.Eval(`:second`)
+	if err != nil {
+		t.Fatalf("failed to reconnect: %s", err)
+	}
+	if len(responses) != 1 || responses[0].Form != ":second" {
+		t.Errorf("unexpected responses: %+v", responses)
+	}
+
+	received := server.Received()
+	restored, evaluated := slices.Index(received, `(in-ns 'restored)`), slices.Index(received, `:second`)
+	if restored < 0 || evaluated < 0 || restored > evaluated {
+		t.Errorf("states were not restored before evaluation: %v", received)
+	}
+}
+
+func TestNotConnected(t *testing.T) {
+	client := NewLazyConnectOnlyClient("127.0.0.1", 1)
+
+	if _, err := client.Ping(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got: %v", err)
+	}
+	if err := client.WriteInput(NewInputToken(), "input"); !errors.Is(err, ErrNoRequestInFlight) {
+		t.Errorf("expected ErrNoRequestInFlight, got: %v", err)
+	}
+}
+
+func TestCleanse(t *testing.T) {
+	tests := []struct {
+		original string
+		expected string
+	}{
+		{
+			original: `{:tag :ret, :val #object[clojure.lang.Atom 0xabc {:status :ready, :val 1}]}`,
+			expected: `{:tag :ret, :val [clojure.lang.Atom \"0xabc\" {:status :ready, :val 1}]}`,
+		},
+		{
+			original: `#object[java.io.File 0x1B2C3D4E "/tmp/plot.png"]`,
+			expected: `[java.io.File \"0x1B2C3D4E\" "/tmp/plot.png"]`,
+		},
+		{
+			// (hex literals outside of `#object[...]` are left untouched)
+			original: `{:tag :ret, :val "0xabc"}`,
+			expected: `{:tag :ret, :val "0xabc"}`,
+		},
+		{
+			original: `{:data #:clojure.error{:phase :execution}}`,
+			expected: `{:data {:phase :execution}}`,
+		},
+	}
+
+	for _, test := range tests {
+		if cleansed := string(cleanse([]byte(test.original))); cleansed != test.expected {
+			t.Errorf("cleanse(%q) = %q, expected %q", test.original, cleansed, test.expected)
+		}
+	}
+}
+
+func TestEvalObject(t *testing.T) {
+	_, client := newTestClient(t, map[string]string{
+		`(atom 1)`: `{:tag :ret, :val "#object[clojure.lang.Atom 0xabc {:status :ready, :val 1}]", :ns "user", :ms 0, :form "(atom 1)"}`,
+	})
+
+	responses, err := client.Eval(`(atom 1)`)
+	if err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+
+	if len(responses) != 1 || responses[0].Tag != "ret" {
+		t.Fatalf("failed to decode response with an object: %+v", responses)
+	}
+	if expected := `[clojure.lang.Atom "0xabc" {:status :ready, :val 1}]`; responses[0].Value != expected {
+		t.Errorf("unexpected value: %q, expected %q", responses[0].Value, expected)
+	}
+}
+
+func TestEvalNewlinesInStrings(t *testing.T) {
+	_, client := newTestClient(t, map[string]string{
+		`(println "a\nb")`: "{:tag :out, :val \"a\nb\n\"}\n{:tag :ret, :val \"nil\", :ns \"user\", :ms 0, :form \"(println \\\"a\\\\nb\\\")\"}",
+		`"x\ny"`:           "{:tag :ret, :val \"\\\"x\\\\ny\\\"\", :ns \"user\", :ms 0, :form \"\\\"x\\\\ny\\\"\"}",
+	})
+
+	responses, err := client.Eval(`(println "a\nb")`)
+	if err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 responses, got %d: %+v", len(responses), responses)
+	}
+	if responses[0].Value != "a\nb\n" {
+		t.Errorf("unexpected output: %q", responses[0].Value)
+	}
+
+	if responses, err = client.Eval(`"x\ny"`); err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+	if len(responses) != 1 || responses[0].Value != `"x\ny"` {
+		t.Errorf("unexpected responses: %+v", responses)
+	}
+}
+
+func TestResponseReader(t *testing.T) {
+	responses := `{:tag :out, :val "{[(\"\n"}
+{:tag :tap, :val "#object[clojure.lang.Atom 0xabc {:status :ready, :val 1}]"}
+{:tag :ret, :val "nil", :ns "user", :ms 0, :form "(tap> (atom 1))"}
+`
+
+	// feed responses byte by byte
+	reader := responseReader{}
+	for i := 1; i <= len(responses); i++ {
+		complete := reader.read([]byte(responses[:i]), 1)
+
+		if i < len(responses)-1 && complete {
+			t.Fatalf("incomplete responses were marked as complete: %q", responses[:i])
+		}
+		if i == len(responses) && (!complete || reader.numRets != 1) {
+			t.Errorf("expected complete responses with 1 `:ret`, got complete: %t, rets: %d", complete, reader.numRets)
+		}
+	}
+}
+
+func TestEvalMultipleForms(t *testing.T) {
+	// the `:ret` of the second form arrives later than the quiet period
+	server, client := newTestClient(t, map[string]string{
+		`(def a 1) (slow-fn)`: `{:tag :ret, :val "#'user/a", :ns "user", :ms 0, :form "(def a 1)"}` +
+			prepltest.Pause +
+			`{:tag :ret, :val "2", :ns "user", :ms 300, :form "(slow-fn)"}`,
+	})
+	if _, err := client.Eval(`:connect`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	server.Delay = 300 * time.Millisecond
+
+	responses, err := client.Eval(`(def a 1) (slow-fn)`)
+	if err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+	if len(responses) != 2 || responses[1].Value != "2" {
+		t.Fatalf("expected 2 responses, got %+v", responses)
+	}
+
+	// next evaluation should not get the stale `:ret`
+	if responses, err = client.Eval(`:next`); err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+	if len(responses) != 1 || responses[0].Form != ":next" {
+		t.Errorf("unexpected responses: %+v", responses)
+	}
+}
+
+func TestEvalOutputAfterRet(t *testing.T) {
+	// an output (eg. printed by a future) arrives right after the `:ret`
+	server, client := newTestClient(t, map[string]string{
+		`(future (println "late"))`: `{:tag :ret, :val "#object[clojure.core$future_call]", :ns "user", :ms 0, :form "(future (println \"late\"))"}` +
+			prepltest.Pause +
+			`{:tag :out, :val "late\n"}`,
+	})
+	if _, err := client.Eval(`:connect`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	server.Delay = 50 * time.Millisecond
+
+	started := time.Now()
+	responses, err := client.Eval(`(future (println "late"))`)
+	if err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("waited too long for the output after `:ret`: %s", elapsed)
+	}
+	if len(responses) != 2 || responses[1].Tag != "out" {
+		t.Errorf("unexpected responses: %+v", responses)
+	}
+
+	// connection should be kept
+	if !client.IsConnected() {
+		t.Errorf("connection was dropped")
+	}
+}
+
+func TestEvalChunked(t *testing.T) {
+	// a long response, which is received in many chunks
+	lines := strings.Repeat("a line with brackets ([{ and \\\"quotes\\\"\\n", 1000)
+	server, client := newTestClient(t, map[string]string{
+		`(print lines)`: fmt.Sprintf(`{:tag :out, :val "%[1]s"}
+{:tag :out, :val "%[1]s"}
+{:tag :ret, :val "nil", :ns "user", :ms 0, :form "(print lines)"}`, lines),
+	})
+	if _, err := client.Eval(`:connect`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	server.ChunkSize = 1000
+	server.Delay = time.Millisecond
+
+	responses, err := client.Eval(`(print lines)`)
+	if err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses, got %d", len(responses))
+	}
+	expected := strings.Repeat("a line with brackets ([{ and \"quotes\"\n", 1000)
+	for _, r := range responses[:2] {
+		if r.Tag != "out" || r.Value != expected {
+			t.Errorf("unexpected output: %s (%d bytes)", r.Tag, len(r.Value))
+		}
+	}
+	if responses[2].Tag != "ret" {
+		t.Errorf("unexpected return value: %+v", responses[2])
+	}
+}
+
+func TestLaunchFailure(t *testing.T) {
+	bin, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("`false` is not available")
+	}
+
+	// (a port which nothing listens on)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	client := NewLazyClient(bin, "127.0.0.1", port)
+
+	// the process exits with non-zero status, which should not crash the whole process
+	client.Lock()
+	err = client.launch()
+	client.Unlock()
+	if err == nil {
+		t.Fatalf("expected an error from the exited PREPL")
+	}
+
+	// (wait for the process to be cleaned up)
+	time.Sleep(100 * time.Millisecond)
+	if client.IsConnected() {
+		t.Errorf("expected the client to be disconnected")
+	}
+}
+
+func TestLazyConnectInitializes(t *testing.T) {
+	server, client := newTestClient(t, nil)
+	client.SetInitForms([]string{`(set! *print-length* 5)`})
+	client.SetAutoRequire([]string{`clojure.string`})
+
+	if _, err := client.Eval(`:first`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	// the existing PREPL is initialized on the first (lazy) connection, before evaluating
+	received := server.Received()
+	evaluated := slices.Index(received, `:first`)
+	for _, form := range []string{`(set! *print-length* 5)`, `(require '[clojure.string])`} {
+		if i := slices.Index(received, form); i < 0 || i > evaluated {
+			t.Errorf("`%s` was not evaluated before the first evaluation: %v", form, received)
+		}
+	}
+}
+
+func TestConnectInitializesOnce(t *testing.T) {
+	server, err := prepltest.NewServer(scripted(nil))
+	if err != nil {
+		t.Fatalf("failed to start fake PREPL server: %s", err)
+	}
+
+	// configured before connecting, so the default init forms should not be evaluated
+	client := NewLazyConnectOnlyClient(server.Host(), server.Port())
+	client.SetInitForms([]string{`(set! *print-length* 5)`})
+	t.Cleanup(func() {
+		client.Shutdown()
+		_ = server.Close()
+	})
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	received := server.Received()
+	for _, form := range DefaultInitForms {
+		if slices.Contains(received, form) {
+			t.Errorf("default init form `%s` was evaluated: %v", form, received)
+		}
+	}
+	count := 0
+	for _, form := range received {
+		if form == `(set! *print-length* 5)` {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("init form was evaluated %d times: %v", count, received)
+	}
+}
+
+func TestWriteInput(t *testing.T) {
+	server, client := newTestClient(t, nil)
+	if _, err := client.Eval(`:connect`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	server.Delay = 300 * time.Millisecond
+
+	token := NewInputToken()
+	evaluated := make(chan error)
+	go func() {
+		_, err := client.EvalContext(WithInputToken(context.Background(), token), `(read-line)`)
+		evaluated <- err
+	}()
+
+	select {
+	case <-token.Written():
+	case <-time.After(time.Second):
+		t.Fatalf("evaluation was not written")
+	}
+
+	// (inputs with other tokens are not written to the evaluation in flight)
+	if err := client.WriteInput(NewInputToken(), "others"); !errors.Is(err, ErrNoRequestInFlight) {
+		t.Errorf("expected ErrNoRequestInFlight for other token, got: %v", err)
+	}
+	if err := client.WriteInput(nil, "others"); !errors.Is(err, ErrNoRequestInFlight) {
+		t.Errorf("expected ErrNoRequestInFlight for no token, got: %v", err)
+	}
+
+	// (only the first line is written)
+	if err := client.WriteInput(token, "mine\nignored"); err != nil {
+		t.Errorf("failed to write input: %s", err)
+	}
+
+	if err := <-evaluated; err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+
+	received := server.Received()
+	if !slices.Contains(received, "mine") || slices.Contains(received, "others") || slices.Contains(received, "ignored") {
+		t.Errorf("unexpected inputs: %v", received)
+	}
+
+	// (no evaluation is in flight anymore)
+	if err := client.WriteInput(token, "late"); !errors.Is(err, ErrNoRequestInFlight) {
+		t.Errorf("expected ErrNoRequestInFlight after evaluation, got: %v", err)
+	}
+}
+
+func TestIsConnectedWhileEvaluating(t *testing.T) {
+	server, client := newTestClient(t, nil)
+	if _, err := client.Eval(`:connect`); err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	server.Delay = 500 * time.Millisecond
+
+	token := NewInputToken()
+	go func() {
+		_, _ = client.EvalContext(WithInputToken(context.Background(), token), `(Thread/sleep 500)`)
+	}()
+	<-token.Written()
+
+	// (does not wait for the evaluation in flight)
+	started := time.Now()
+	if !client.IsConnected() {
+		t.Errorf("expected the client to be connected")
+	}
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Errorf("IsConnected was blocked by the evaluation in flight (took %s)", elapsed)
+	}
+}
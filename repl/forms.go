@@ -0,0 +1,159 @@
+package repl
+
+// splitting codes into top-level forms
+
+import (
+	"strings"
+	"unicode"
+)
+
+// SplitForms splits given code into top-level forms,
+// and returns the remaining text which could not be read as a form (eg. with unbalanced brackets)
+func SplitForms(code string) (forms []string, rest string) {
+	runes := []rune(code)
+
+	i := skipIgnorables(runes, 0)
+	for i < len(runes) {
+		end, ok := readForm(runes, i)
+		if !ok {
+			return forms, strings.TrimSpace(string(runes[i:]))
+		}
+
+		forms = append(forms, strings.TrimSpace(string(runes[i:end])))
+		i = skipIgnorables(runes, end)
+	}
+
+	return forms, ""
+}
+
+// Balanced checks if given code can be read as complete forms
+// (eg. has no unbalanced delimiters or unterminated strings, which would keep PREPL waiting for the rest of them)
+func Balanced(code string) bool {
+	_, rest := SplitForms(code)
+
+	return rest == ""
+}
+
+// closing brackets of opening ones
+var closingBrackets = map[rune]rune{'(': ')', '[': ']', '{': '}'}
+
+// check if given rune ends a token
+func isDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`,()[]{}";`, r)
+}
+
+// skip whitespaces, commas, comments, and discarded (`#_`) forms from given index
+func skipIgnorables(runes []rune, i int) int {
+	for i < len(runes) {
+		switch {
+		case unicode.IsSpace(runes[i]) || runes[i] == ',':
+			i++
+		case runes[i] == ';' || (runes[i] == '#' && i+1 < len(runes) && runes[i+1] == '!'): // comments
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case runes[i] == '#' && i+1 < len(runes) && runes[i+1] == '_': // discarded form
+			end, ok := readForm(runes, skipIgnorables(runes, i+2))
+			if !ok {
+				return i
+			}
+			i = end
+		default:
+			return i
+		}
+	}
+
+	return i
+}
+
+// read a form from given index, and return the index right after it
+func readForm(runes []rune, i int) (end int, ok bool) {
+	if i >= len(runes) {
+		return i, false
+	}
+
+	switch r := runes[i]; r {
+	case '(', '[', '{':
+		closing := closingBrackets[r]
+		for i = skipIgnorables(runes, i+1); i < len(runes); i = skipIgnorables(runes, i) {
+			switch runes[i] {
+			case closing:
+				return i + 1, true
+			case ')', ']', '}':
+				return i, false
+			}
+
+			if i, ok = readForm(runes, i); !ok {
+				return i, false
+			}
+		}
+		return i, false
+	case ')', ']', '}':
+		return i, false
+	case '"':
+		for i++; i < len(runes); i++ {
+			switch runes[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, true
+			}
+		}
+		return i, false
+	case '\\': // character literals (eg. `\a`, `\(`, `\newline`)
+		i += 2
+		for i < len(runes) && !isDelimiter(runes[i]) {
+			i++
+		}
+		return min(i, len(runes)), i <= len(runes)
+	case '\'', '`', '@':
+		return readForm(runes, skipIgnorables(runes, i+1))
+	case '~':
+		if i+1 < len(runes) && runes[i+1] == '@' {
+			i++
+		}
+		return readForm(runes, skipIgnorables(runes, i+1))
+	case '^': // metadata, and the form with it
+		if i, ok = readForm(runes, skipIgnorables(runes, i+1)); !ok {
+			return i, false
+		}
+		return readForm(runes, skipIgnorables(runes, i))
+	case '#':
+		return readDispatch(runes, i)
+	default: // symbols, keywords, numbers, ...
+		for i < len(runes) && !isDelimiter(runes[i]) {
+			i++
+		}
+		return i, true
+	}
+}
+
+// read a form which starts with `#` from given index, and return the index right after it
+func readDispatch(runes []rune, i int) (end int, ok bool) {
+	if i+1 >= len(runes) {
+		return i, false
+	}
+
+	switch runes[i+1] {
+	case '{', '(', '"': // sets, anonymous functions, and regular expressions
+		return readForm(runes, i+1)
+	case '\'': // var quotes
+		return readForm(runes, skipIgnorables(runes, i+2))
+	case '?': // reader conditionals (eg. `#?(...)`, `#?@(...)`)
+		i += 2
+		if i < len(runes) && runes[i] == '@' {
+			i++
+		}
+		return readForm(runes, i)
+	case '#': // symbolic values (eg. `##Inf`)
+		return readForm(runes, i+2)
+	case '_':
+		return i, false
+	default: // namespaced maps (eg. `#:a{:b 1}`) and tagged literals (eg. `#inst "..."`)
+		i++
+		for i < len(runes) && !isDelimiter(runes[i]) {
+			i++
+		}
+		return readForm(runes, skipIgnorables(runes, i))
+	}
+}
@@ -0,0 +1,77 @@
+package repl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitForms(t *testing.T) {
+	tests := []struct {
+		code  string
+		forms []string
+		rest  string
+	}{
+		{code: ``, forms: nil},
+		{code: `(+ 1 2)`, forms: []string{`(+ 1 2)`}},
+		{code: `(def x 1) (inc x)`, forms: []string{`(def x 1)`, `(inc x)`}},
+		{code: `1 :a "b" \c`, forms: []string{`1`, `:a`, `"b"`, `\c`}},
+
+		// strings with brackets and escaped quotes
+		{code: `(str "(" "]" "}") (println "\"(")`, forms: []string{`(str "(" "]" "}")`, `(println "\"(")`}},
+
+		// character literals of brackets
+		{code: `(str \( \) \[) (str \" \;)`, forms: []string{`(str \( \) \[)`, `(str \" \;)`}},
+
+		// comments
+		{code: "(inc 1) ; (dec 1\n(dec 2)", forms: []string{`(inc 1)`, `(dec 2)`}},
+		{code: "(+ 1 ; )\n 2)", forms: []string{"(+ 1 ; )\n 2)"}},
+
+		// discarded forms
+		{code: `#_(unbalanced "(" ) (inc 1)`, forms: []string{`(inc 1)`}},
+		{code: `(+ 1 #_ #_ 2 3 4)`, forms: []string{`(+ 1 #_ #_ 2 3 4)`}},
+
+		// reader conditionals (with splicing)
+		{code: `#?(:clj 1 :cljs 2) [#?@(:clj [1 2])]`, forms: []string{`#?(:clj 1 :cljs 2)`, `[#?@(:clj [1 2])]`}},
+
+		// dispatch macros, quotes, and metadata
+		{code: `#{1 2} #(inc %) #"\(" #'inc @(atom 1) '(1) ^:private x`, forms: []string{`#{1 2}`, `#(inc %)`, `#"\("`, `#'inc`, `@(atom 1)`, `'(1)`, `^:private x`}},
+
+		// unbalanced
+		{code: `(inc 1) (dec`, forms: []string{`(inc 1)`}, rest: `(dec`},
+		{code: `(str "unterminated)`, forms: nil, rest: `(str "unterminated)`},
+		{code: `(inc 1))`, forms: []string{`(inc 1)`}, rest: `)`},
+		{code: `(inc [1)]`, forms: nil, rest: `(inc [1)]`},
+	}
+
+	for _, test := range tests {
+		forms, rest := SplitForms(test.code)
+		if !reflect.DeepEqual(forms, test.forms) || rest != test.rest {
+			t.Errorf("SplitForms(%q) = (%q, %q), expected (%q, %q)", test.code, forms, rest, test.forms, test.rest)
+		}
+	}
+}
+
+func TestBalanced(t *testing.T) {
+	tests := []struct {
+		code     string
+		balanced bool
+	}{
+		{code: `(println "(")`, balanced: true},
+		{code: `(println "\")")`, balanced: true},
+		{code: `(str \()`, balanced: true},
+		{code: "(inc 1) ; )", balanced: true},
+		{code: "; (", balanced: true},
+		{code: `#_(`, balanced: false},
+		{code: `#_[1 2] 3`, balanced: true},
+		{code: `#?@(:clj [1]`, balanced: false},
+		{code: `(println "(`, balanced: false},
+		{code: `(let [x 1) x)`, balanced: false},
+		{code: `)`, balanced: false},
+	}
+
+	for _, test := range tests {
+		if balanced := Balanced(test.code); balanced != test.balanced {
+			t.Errorf("Balanced(%q) = %t, expected %t", test.code, balanced, test.balanced)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package repl
+
+// output formatting codes
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"olympos.io/encoding/edn"
+)
+
+// OutputPartType is a type of output part
+type OutputPartType int
+
+// OutputPartType constants
+const (
+	Stdout OutputPartType = iota
+	Stderr
+	Return
+	Exception
+	Unhandled
+)
+
+// OutputPart is a typed part of REPL output
+type OutputPart struct {
+	Type      OutputPartType
+	Namespace string // namespace of returned value, from its own response (empty if not needed)
+	Text      string
+}
+
+// DefaultPrompt is the default prompt between the namespace and returned value
+const DefaultPrompt = "=> "
+
+// String converts output part to string
+func (p OutputPart) String() string {
+	return p.StringWithPrompt(DefaultPrompt)
+}
+
+// StringWithPrompt converts output part to string, with given prompt after the namespace
+func (p OutputPart) StringWithPrompt(prompt string) string {
+	if p.Namespace != "" {
+		return p.Namespace + prompt + p.Text
+	}
+
+	return p.Text
+}
+
+// RespToParts converts REPL response to typed output parts
+//
+// (each returned value keeps the namespace of its own response, so prefixes follow namespace changes between forms)
+func RespToParts(responses []Response) []OutputPart {
+	parts := []OutputPart{}
+
+	for _, r := range responses {
+		if r.Exception { // PREPL error exists
+			var exception ExceptionValue
+			if err := edn.Unmarshal([]byte(r.Value), &exception); err == nil {
+				text := strings.TrimSpace(exception.Cause)
+				if hint := exception.Hint(); hint != "" {
+					text += "\n" + hint
+				}
+				parts = append(parts, OutputPart{Type: Exception, Text: text})
+			} else {
+				errStr := fmt.Sprintf("failed to unmarshal exception value: %s", err)
+
+				log.Print(errStr)
+
+				switch r.Tag {
+				case "ret":
+					parts = append(parts, OutputPart{Type: Exception, Namespace: r.Namespace, Text: strings.TrimSpace(r.Value)})
+				case "out", "err":
+					parts = append(parts, OutputPart{Type: Exception, Text: strings.TrimSpace(r.Value)})
+				default:
+					parts = append(parts, OutputPart{Type: Unhandled, Text: errStr})
+				}
+			}
+		} else {
+			switch r.Tag {
+			case "ret":
+				parts = append(parts, OutputPart{Type: Return, Namespace: r.Namespace, Text: strings.TrimSpace(r.Value)})
+			case "out":
+				parts = append(parts, OutputPart{Type: Stdout, Text: strings.TrimSpace(r.Value)})
+			case "err":
+				parts = append(parts, OutputPart{Type: Stderr, Text: strings.TrimSpace(r.Value)})
+			default:
+				errStr := fmt.Sprintf("unhandled `%s` response: %+v", r.Tag, r)
+
+				log.Print(errStr)
+
+				parts = append(parts, OutputPart{Type: Unhandled, Text: errStr})
+			}
+		}
+	}
+
+	// (Telegram rejects texts with invalid UTF-8 sequences, eg. raw bytes printed by some libraries)
+	for i := range parts {
+		parts[i].Text = ValidUTF8(parts[i].Text)
+	}
+
+	return parts
+}
+
+// ValidUTF8 replaces invalid UTF-8 sequences in given string with the replacement character (U+FFFD)
+func ValidUTF8(str string) string {
+	return strings.ToValidUTF8(str, string(utf8.RuneError))
+}
+
+// hints for exceptions of missing classes or namespaces
+const (
+	hintMissingClass     = "(hint: this class is not available, check your dependencies)"
+	hintMissingNamespace = "(hint: this namespace is not available, check your dependencies)"
+)
+
+// regular expressions for causes of exceptions on missing classes or namespaces
+var (
+	reMissingClass     = regexp.MustCompile(`^Unable to resolve classname: `)
+	reMissingNamespace = regexp.MustCompile(`^Could not locate .+ on classpath`)
+)
+
+// Hint returns a friendly hint for this exception (eg. for missing dependencies), or an empty string if there is none
+func (e ExceptionValue) Hint() string {
+	for _, via := range e.Via {
+		if via.Type == "java.lang.ClassNotFoundException" || via.Type == "java.lang.NoClassDefFoundError" {
+			return hintMissingClass
+		}
+	}
+
+	cause := strings.TrimSpace(e.Cause)
+	if reMissingNamespace.MatchString(cause) {
+		return hintMissingNamespace
+	} else if reMissingClass.MatchString(cause) {
+		return hintMissingClass
+	}
+
+	return ""
+}
+
+// RespToString converts REPL response to string
+func RespToString(responses []Response) string {
+	return PartsToString(RespToParts(responses))
+}
+
+// RespToBareString converts REPL response to string without the namespace prefix of a returned value
+//
+// (prefixes are kept when there are multiple returned values, for readability)
+func RespToBareString(responses []Response) string {
+	return PartsToString(BareParts(RespToParts(responses)))
+}
+
+// BareParts removes namespaces from given output parts, if there is only one returned value in them
+func BareParts(parts []OutputPart) []OutputPart {
+	numReturns := 0
+	for _, part := range parts {
+		if part.Type == Return {
+			numReturns++
+		}
+	}
+	if numReturns <= 1 {
+		for i := range parts {
+			parts[i].Namespace = ""
+		}
+	}
+
+	return parts
+}
+
+// CollapseDuplicateParts collapses identical consecutive output parts into one, with a suffix of their count (eg. ` (x2)`)
+func CollapseDuplicateParts(parts []OutputPart) []OutputPart {
+	collapsed := []OutputPart{}
+
+	for i := 0; i < len(parts); {
+		count := 1
+		for i+count < len(parts) && parts[i+count] == parts[i] {
+			count++
+		}
+
+		part := parts[i]
+		if count > 1 {
+			part.Text = fmt.Sprintf("%s (x%d)", part.Text, count)
+		}
+		collapsed = append(collapsed, part)
+
+		i += count
+	}
+
+	return collapsed
+}
+
+// PartsToString joins output parts as a string
+func PartsToString(parts []OutputPart) string {
+	return PartsToStringWithPrompt(parts, DefaultPrompt)
+}
+
+// PartsToStringWithPrompt joins output parts as a string, with given prompt after namespaces
+func PartsToStringWithPrompt(parts []OutputPart, prompt string) string {
+	msgs := []string{}
+
+	for _, part := range parts {
+		msgs = append(msgs, part.StringWithPrompt(prompt))
+	}
+
+	// join them
+	return strings.Join(msgs, "\n")
+}
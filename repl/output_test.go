@@ -0,0 +1,136 @@
+package repl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollapseDuplicateParts(t *testing.T) {
+	tests := []struct {
+		name     string
+		parts    []OutputPart
+		expected []OutputPart
+	}{
+		{
+			name:     "empty",
+			parts:    []OutputPart{},
+			expected: []OutputPart{},
+		},
+		{
+			name: "runs",
+			parts: []OutputPart{
+				{Type: Stdout, Text: "tick"},
+				{Type: Stdout, Text: "tick"},
+				{Type: Stdout, Text: "tick"},
+				{Type: Return, Namespace: "user", Text: "nil"},
+			},
+			expected: []OutputPart{
+				{Type: Stdout, Text: "tick (x3)"},
+				{Type: Return, Namespace: "user", Text: "nil"},
+			},
+		},
+		{
+			name: "non-adjacent duplicates",
+			parts: []OutputPart{
+				{Type: Stdout, Text: "a"},
+				{Type: Stdout, Text: "b"},
+				{Type: Stdout, Text: "a"},
+				{Type: Stdout, Text: "a"},
+			},
+			expected: []OutputPart{
+				{Type: Stdout, Text: "a"},
+				{Type: Stdout, Text: "b"},
+				{Type: Stdout, Text: "a (x2)"},
+			},
+		},
+		{
+			name: "different types",
+			parts: []OutputPart{
+				{Type: Stdout, Text: "same"},
+				{Type: Stderr, Text: "same"},
+				{Type: Return, Text: "same"},
+			},
+			expected: []OutputPart{
+				{Type: Stdout, Text: "same"},
+				{Type: Stderr, Text: "same"},
+				{Type: Return, Text: "same"},
+			},
+		},
+		{
+			name: "different namespaces",
+			parts: []OutputPart{
+				{Type: Return, Namespace: "user", Text: "nil"},
+				{Type: Return, Namespace: "other", Text: "nil"},
+				{Type: Return, Namespace: "other", Text: "nil"},
+			},
+			expected: []OutputPart{
+				{Type: Return, Namespace: "user", Text: "nil"},
+				{Type: Return, Namespace: "other", Text: "nil (x2)"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if collapsed := CollapseDuplicateParts(test.parts); !reflect.DeepEqual(collapsed, test.expected) {
+			t.Errorf("[%s] CollapseDuplicateParts() = %+v, expected %+v", test.name, collapsed, test.expected)
+		}
+	}
+}
+
+func TestNamespacePrefixesFollowInNs(t *testing.T) {
+	// responses of `(def a 1) (in-ns 'other) (def b 2) (in-ns 'user)`
+	responses := []Response{
+		{Tag: "ret", Value: "#'user/a", Namespace: "user", Form: "(def a 1)"},
+		{Tag: "ret", Value: "#object[clojure.lang.Namespace 0x1 \"other\"]", Namespace: "other", Form: "(in-ns 'other)"},
+		{Tag: "ret", Value: "#'other/b", Namespace: "other", Form: "(def b 2)"},
+		{Tag: "out", Value: "printed\n"},
+		{Tag: "ret", Value: "#object[clojure.lang.Namespace 0x2 \"user\"]", Namespace: "user", Form: "(in-ns 'user)"},
+	}
+
+	expected := `user=> #'user/a
+other=> #object[clojure.lang.Namespace 0x1 "other"]
+other=> #'other/b
+printed
+user=> #object[clojure.lang.Namespace 0x2 "user"]`
+	if str := RespToString(responses); str != expected {
+		t.Errorf("RespToString() = %q, expected %q", str, expected)
+	}
+
+	// (prefixes are kept in bare strings, as there are multiple returned values)
+	if str := RespToBareString(responses); str != expected {
+		t.Errorf("RespToBareString() = %q, expected %q", str, expected)
+	}
+
+	// (no prefix for a single returned value)
+	if str := RespToBareString(responses[2:3]); str != `#'other/b` {
+		t.Errorf("RespToBareString() = %q, expected %q", str, `#'other/b`)
+	}
+}
+
+func TestValidUTF8(t *testing.T) {
+	tests := []struct {
+		str      string
+		expected string
+	}{
+		{str: "hello", expected: "hello"},
+		{str: "안녕 👋", expected: "안녕 👋"},
+		{str: "a\xffb", expected: "a�b"},
+		{str: "\xc3\x28", expected: "�("},             // invalid 2-byte sequence
+		{str: "\xe2\x82", expected: "�"},              // truncated 3-byte sequence
+		{str: "\xed\xa0\x80", expected: "�"},          // (surrogate half)
+		{str: "x\xff\xfe\xfdy", expected: "x�y"},      // (consecutive invalid bytes are replaced once)
+		{str: "\xf0\x9f\x91\x8b\xf0", expected: "👋�"}, // valid, then truncated
+	}
+
+	for _, test := range tests {
+		if valid := ValidUTF8(test.str); valid != test.expected {
+			t.Errorf("ValidUTF8(%q) = %q, expected %q", test.str, valid, test.expected)
+		}
+	}
+
+	// (applied to output parts)
+	parts := RespToParts([]Response{{Tag: "out", Value: "raw \x89PNG"}})
+	if len(parts) != 1 || parts[0].Text != "raw �PNG" {
+		t.Errorf("invalid UTF-8 sequences were not replaced in output parts: %+v", parts)
+	}
+}
@@ -0,0 +1,91 @@
+package repl
+
+// capturing outputs (stdout and stderr) of the launched PREPL process
+
+import (
+	"bytes"
+	"log"
+	"sync"
+)
+
+const (
+	maxProcessLogLines        = 500
+	maxProcessLogLinesOnError = 20 // lines to log when the process exits with error
+)
+
+// processLog keeps the last lines of outputs of the launched PREPL process (bounded by `maxProcessLogLines`)
+type processLog struct {
+	lines   []string // ring buffer of lines
+	next    int      // index of `lines` for the next line
+	partial []byte   // last line which is not terminated yet
+
+	logLines *bool // also log lines if it is true (eg. `Client.LogOutput`)
+
+	sync.Mutex
+}
+
+// newProcessLog returns a new process log
+func newProcessLog(logLines *bool) *processLog {
+	return &processLog{
+		lines:    make([]string, 0, maxProcessLogLines),
+		logLines: logLines,
+	}
+}
+
+// Write appends given bytes (implements io.Writer)
+func (l *processLog) Write(p []byte) (n int, err error) {
+	l.Lock()
+
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		l.append(string(bytes.TrimRight(l.partial[:i], "\r")))
+		l.partial = l.partial[i+1:]
+	}
+
+	l.Unlock()
+
+	return len(p), nil
+}
+
+// append a line to the ring buffer
+//
+// NOTE: should be called while locked
+func (l *processLog) append(line string) {
+	if l.logLines != nil && *l.logLines {
+		log.Printf("[REPL] %s", line)
+	}
+
+	if len(l.lines) < maxProcessLogLines {
+		l.lines = append(l.lines, line)
+	} else {
+		l.lines[l.next] = line
+	}
+	l.next = (l.next + 1) % maxProcessLogLines
+}
+
+// last returns the last `n` lines (in order)
+func (l *processLog) last(n int) []string {
+	l.Lock()
+
+	if n > len(l.lines) {
+		n = len(l.lines)
+	}
+
+	lines := make([]string, 0, n)
+	for i := len(l.lines) - n; i < len(l.lines); i++ {
+		if len(l.lines) < maxProcessLogLines {
+			lines = append(lines, l.lines[i])
+		} else {
+			lines = append(lines, l.lines[(l.next+i)%maxProcessLogLines])
+		}
+	}
+
+	l.Unlock()
+
+	return lines
+}